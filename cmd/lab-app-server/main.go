@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"time"
 
 	flag "github.com/spf13/pflag"
 
 	"github.com/mtulio/go-lab-api/internal/client"
 	"github.com/mtulio/go-lab-api/internal/event"
+	"github.com/mtulio/go-lab-api/internal/flagutil"
 	"github.com/mtulio/go-lab-api/internal/metric"
 	"github.com/mtulio/go-lab-api/internal/server"
 	"github.com/mtulio/go-lab-api/internal/watcher"
@@ -17,52 +21,124 @@ var (
 	logPath      *string = flag.String("log-path", "", "help message for flagname")
 	svcProto     *string = flag.String("service-proto", "http", "help message for flagname")
 	svcPort      *uint64 = flag.Uint64("service-port", 30300, "help message for flagname")
+	instanceID   *string = flag.String("instance-id", "", "Identifier of the instance, sent on the X-Instance-Id header of HTTP responses. Default is the hostname.")
+	svcTCPMode   *string = flag.String("service-tcp-mode", "command", "Protocol of TCP/TLS service server: command (PING, HEALTH, ECHO, SLEEP, CLOSE, STATS), echo, discard, chargen.")
 	certPem      *string = flag.String("cert-pem", "", "help message for flagname")
 	certKey      *string = flag.String("cert-key", "", "help message for flagname")
 	hcProto      *string = flag.String("health-check-proto", "http", "help message for flagname")
 	hcPort       *uint64 = flag.Uint64("health-check-port", 30301, "help message for flagname")
 	hcPath       *string = flag.String("health-check-path", "/readyz", "help message for flagname")
-	watchTg      *string = flag.String("watch-target-group-arn", "", "help message for flagname")
+	hcTCPMode    *string = flag.String("health-check-tcp-unhealthy-mode", "close", "Behavior of TCP/TLS health check server when unhealthy: close (listener), reset (accept and RST), hang (accept and never answer).")
+	hcInterval   *uint64 = flag.Uint64("health-check-interval", 30, "Health check interval (seconds) configured on Target Group, compared with the observed probe interval.")
+	probesSum    *uint64 = flag.Uint64("probes-summary-interval", 60, "Interval (seconds) to publish the health check probes summary. 0 is to disable.")
+	watchTg      *string = flag.String("watch-target-group-arn", "", "Comma-separated target group or load balancer ARNs to watch, the load balancers are resolved to all their target groups.")
+	watchTgInt   *uint64 = flag.Uint64("watch-target-group-interval", 1, "Interval (seconds) to describe the target group health, errors are retried with backoff.")
+	watchRate    *uint64 = flag.Uint64("watch-rate-limit", 5, "Maximum describe calls per second, shared by all the watched target groups. 0 is to use the default, the limit can't be disabled.")
+	awsRegion    *string = flag.String("watch-aws-region", "", "AWS region of the watched target groups. Default is the ambient configuration (AWS_REGION, shared config).")
+	awsProfile   *string = flag.String("watch-aws-profile", "", "AWS shared config profile used by the target group watcher.")
+	awsRoleARN   *string = flag.String("watch-aws-role-arn", "", "ARN of the role assumed by the target group watcher.")
+	awsRoleSess  *string = flag.String("watch-aws-role-session-name", "go-lab-api-watcher", "Session name of the role assumed by the target group watcher.")
+	awsEndpoint  *string = flag.String("watch-aws-endpoint", "", "Custom ELBv2 endpoint URL, eg: a local emulator (LocalStack or moto) http://localhost:4566.")
+	watchReplay  *string = flag.String("watch-target-replay", "", "Fake target group backend to run labs offline: JSON lines file replaying recorded target states (or the log of a previous run), or HTTP URL returning the current targets.")
+	watchSelf    *string = flag.String("watch-self-target", "", "Target ID (IP or instance ID) of this instance on the target group. Default is to detect from local IPs and instance metadata.")
+	watchSelfPt  *uint64 = flag.Uint64("watch-self-target-port", 0, "Port of the self target on the target group, the targets of the self ID on other ports are ignored. Default is the service port.")
+	watchMeta    *string = flag.String("watch-metadata-endpoint", "http://169.254.169.254", "Instance metadata endpoint used to detect the self target, a local stand-in can be used on labs.")
+	watchExp     *bool   = flag.Bool("watch-experiment", false, "Run the experiment deregistering the self target from the watched target groups in sequence, waiting it to drain, then registering it again and waiting it to be healthy.")
+	watchExpDry  *bool   = flag.Bool("watch-experiment-dry-run", false, "Report the experiment actions without deregistering the self target.")
+	watchExpDly  *uint64 = flag.Uint64("watch-experiment-delay", 60, "Delay (seconds) to start the experiment, measuring the baseline traffic.")
+	watchExpTmo  *uint64 = flag.Uint64("watch-experiment-timeout", 3600, "Timeout (seconds) to wait each target state of the experiment.")
 	termTimeout  *uint64 = flag.Uint64("termination-timeout", 300, "help message for flagname")
+	preStopDelay *uint64 = flag.Uint64("termination-pre-stop-delay", 0, "Delay (seconds) after termination starts to fail the health check.")
+	hardDeadline *uint64 = flag.Uint64("termination-hard-deadline", 0, "Deadline (seconds) after termination starts to exit the process, even when the termination timeout restored the health. 0 is to disable.")
+	exitOnTmo    *bool   = flag.Bool("termination-exit-on-timeout", false, "Exit the process when termination timeout is reached, instead of restoring the healthy state.")
+	sigActions   *string = flag.String("signal-actions", "", "Comma-separated actions for signals, format SIGNAL=action. Actions: terminate, healthy, unhealthy, toggle-health, exit, ignore. Eg: SIGUSR1=toggle-health,SIGHUP=ignore")
+	tcpKeepAliv  *int64  = flag.Int64("tcp-keepalive", -1, "TCP keepalive period (seconds) of the connections accepted by the TCP servers. -1 is to disable, 0 is the Go default.")
+	idleTimeout  *uint64 = flag.Uint64("idle-timeout", 0, "Close server connections without activity after timeout (seconds). 0 is to disable.")
 	debug        *bool   = flag.Bool("debug", false, "Enable debug mode")
-	cliGenReqURL *string = flag.String("gen-requests-to-url", "", "Make background requests to URL and measure it.")
+	cliGenReqURL *string = flag.String("gen-requests-to-url", "", "Make background requests to URL and measure it. Comma-separated URLs are requested in round robin.")
 	cliGenReqInt *uint64 = flag.Uint64("gen-requests-interval", 250, "Interval between each requests (milisseconds")
 	cliGenReqTmo *uint8  = flag.Uint8("gen-requests-timeout", 5, "Context timeout for each requests (seconds)")
-	cliGenReqCnt *uint64 = flag.Uint64("gen-requests-count", 0, "Amount of requests to generate to the target. 0 is to infinite.")
+	cliGenReqCnt *uint64 = flag.Uint64("gen-requests-count", 0, "Amount of requests to generate to the target. 0 is to infinite. Not supported with --gen-requests-rps, set --gen-requests-duration.")
 	cliGenReqSS  *uint8  = flag.Uint8("gen-requests-slow-start", 10, "Amount of time in seconds to wait to send the first request.")
+	cliGenReqBMn *uint64 = flag.Uint64("gen-requests-backoff-min", 500, "Minimum backoff after a request error (milisseconds).")
+	cliGenReqBMx *uint64 = flag.Uint64("gen-requests-backoff-max", 10000, "Maximum backoff after consecutive request errors (milisseconds).")
+	cliGenReqNKA *bool   = flag.Bool("gen-requests-no-keepalive", false, "Disable the TCP keepalive of the client connections.")
+	cliGenReqNew *bool   = flag.Bool("gen-requests-new-conn", false, "Open a new connection for each request, instead of reusing the connection pool.")
+	cliGenReqPin *string = flag.String("gen-requests-pin-ips", "", "Comma-separated IPs to connect to, ignoring the DNS of the URLs.")
+	cliGenReqDNS *uint64 = flag.Uint64("gen-requests-resolve-interval", 0, "Resolve the URL hosts on the interval (seconds), connecting to the resolved IPs in round robin. 0 uses the system resolver on each new connection.")
+	cliGenReqRPS *uint64 = flag.Uint64("gen-requests-rps", 0, "Target requests per second of the open-loop load generator. 0 is to use the interval loop.")
+	cliGenReqCon *uint64 = flag.Uint64("gen-requests-concurrency", 10, "Amount of concurrent workers of the load generator.")
+	cliGenReqDur *uint64 = flag.Uint64("gen-requests-duration", 0, "Duration (seconds) of the load generator steady phase. 0 is to infinite.")
+	cliGenReqRUp *uint64 = flag.Uint64("gen-requests-ramp-up", 0, "Duration (seconds) of the load generator ramp-up.")
+	cliGenReqRDn *uint64 = flag.Uint64("gen-requests-ramp-down", 0, "Duration (seconds) of the load generator ramp-down.")
+	cliGenReqRep *uint64 = flag.Uint64("gen-requests-report-interval", 10, "Interval (seconds) to report the load generator latency, and the backends of the client. 0 is to report the backends only at the end.")
+	cliGenTCPTo  *string = flag.String("gen-tcp-to-addr", "", "Open persistent TCP connections to address (host:port) sending messages on the ServerTCP protocol.")
+	cliGenTCPTLS *bool   = flag.Bool("gen-tcp-tls", false, "Use TLS on the persistent TCP connections.")
+	cliGenTCPCon *uint64 = flag.Uint64("gen-tcp-conns", 1, "Amount of persistent TCP connections.")
+	cliGenTCPInt *uint64 = flag.Uint64("gen-tcp-interval", 1000, "Interval between each message on the TCP connections (milisseconds).")
+	cliGenTCPTmo *uint8  = flag.Uint8("gen-tcp-timeout", 5, "Timeout for connect and each message round trip on TCP connections (seconds).")
+	cliGenTCPBck *uint64 = flag.Uint64("gen-tcp-backoff-max", 10000, "Maximum backoff to reconnect the TCP connections (milisseconds).")
+
+	// repeatable flag, the sink options have commas
+	eventSinks *[]string = flag.StringArray("event-sink", nil, "Event sink, repeat to fan out the events to several sinks: stderr, stdout, file:///path?max-size=MB&max-age=24h&max-backups=N, syslog+udp://host:514, syslog+tcp://host:601, syslog+unix:///dev/log, https://url?batch=100&flush=1s&retries=3. The option types=runtime,request filters the event types of a sink. Default is stderr, or the --log-path file.")
 )
 
 func main() {
 	flag.Parse()
 	readyToShutdown := make(chan struct{})
 
-	ev := event.NewEventHandler(*appName, *logPath)
-	metric := metric.NewMetricHandler(ev)
-	go metric.StartPusher()
+	ev, err := event.NewEventHandlerWithSinks(*appName, event.SinkSpecs(*eventSinks, *logPath))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer ev.Close()
 
-	// Watch Target Group and extract/update metrics
-	tgw, err := watcher.NewTargetGroupWatcher(&watcher.TGWatcherOptions{
-		ARN:    *watchTg,
-		Metric: metric,
-	})
+	signalActions, err := server.ParseSignalActions(*sigActions)
 	if err != nil {
 		log.Fatal(err)
 	}
-	go tgw.Start()
+
+	if *instanceID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatal(err)
+		}
+		*instanceID = hostname
+	}
+
+	metric := metric.NewMetricHandler(ev)
+	go metric.StartPusher()
+
+	// the watcher API calls are canceled when the app exits, by the
+	// exit paths of the Health Check Controller
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	// the listener will handle the servers (service and health-check)
 	lnc := server.ListenerOptions{
 		ServiceProto:       server.GetProtocolFromStr(*svcProto),
 		ServicePort:        *svcPort,
+		ServiceTCPMode:     server.GetTCPModeFromStr(*svcTCPMode),
 		HCProto:            server.GetProtocolFromStr(*hcProto),
 		HCPort:             *hcPort,
 		HCPath:             *hcPath,
+		HCUnhealthyMode:    server.GetTCPUnhealthyModeFromStr(*hcTCPMode),
 		CertPem:            *certPem,
 		CertKey:            *certKey,
 		Event:              ev,
 		Metric:             metric,
 		Debug:              *debug,
 		TerminationTimeout: *termTimeout,
+		PreStopDelay:       *preStopDelay,
+		HardDeadline:       *hardDeadline,
+		ExitOnTimeout:      *exitOnTmo,
+		SignalActions:      signalActions,
+		OnExit:             cancel,
+		TCPKeepAlive:       time.Duration(*tcpKeepAliv) * time.Second,
+		IdleTimeout:        time.Duration(*idleTimeout) * time.Second,
+		HCInterval:         *hcInterval,
+		ProbesSummary:      *probesSum,
+		InstanceID:         *instanceID,
 	}
 
 	ln, err := server.NewListener(&lnc)
@@ -72,21 +148,107 @@ func main() {
 
 	ln.Start()
 
+	// Watch Target Group and extract/update metrics, the watcher is a
+	// no-op when there is no target group or replay.
+	var experiment *watcher.ExperimentOptions
+	if *watchExp || *watchExpDry {
+		experiment = &watcher.ExperimentOptions{
+			DryRun:  *watchExpDry,
+			Delay:   time.Duration(*watchExpDly) * time.Second,
+			Timeout: time.Duration(*watchExpTmo) * time.Second,
+		}
+	}
+	selfPort := *watchSelfPt
+	if selfPort == 0 {
+		selfPort = *svcPort
+	}
+	tgw, err := watcher.NewTargetWatcher(&watcher.TGWatcherOptions{
+		Context:  ctx,
+		ARNs:     flagutil.SplitList(*watchTg),
+		Replay:   *watchReplay,
+		Interval: time.Duration(*watchTgInt) * time.Second,
+		Metric:   metric,
+		Event:    ev,
+		AppState: ln.Subscribe(),
+
+		RateLimit:        float64(*watchRate),
+		SelfTarget:       *watchSelf,
+		SelfPort:         int64(selfPort),
+		MetadataEndpoint: *watchMeta,
+		Experiment:       experiment,
+
+		AWS: watcher.AWSOptions{
+			Region:          *awsRegion,
+			Profile:         *awsProfile,
+			RoleARN:         *awsRoleARN,
+			RoleSessionName: *awsRoleSess,
+			Endpoint:        *awsEndpoint,
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	go tgw.Start()
+
 	// Start the client request generator, and measure it with server
 	// metrics.
 	if *cliGenReqURL != "" {
 		curlCfg := client.CurlOptions{
-			Endpoint:     *cliGenReqURL,
-			IntervalMs:   *cliGenReqInt,
-			TimeoutSec:   *cliGenReqTmo,
-			SlowStartSec: *cliGenReqSS,
-			Count:        *cliGenReqCnt,
+			Endpoints:          flagutil.SplitList(*cliGenReqURL),
+			IntervalMs:         *cliGenReqInt,
+			TimeoutSec:         *cliGenReqTmo,
+			SlowStartSec:       *cliGenReqSS,
+			Count:              *cliGenReqCnt,
+			BackoffMinMs:       *cliGenReqBMn,
+			BackoffMaxMs:       *cliGenReqBMx,
+			Debug:              *debug,
+			DisableKeepAlive:   *cliGenReqNKA,
+			NewConnection:      *cliGenReqNew,
+			PinIPs:             flagutil.SplitList(*cliGenReqPin),
+			ResolveIntervalSec: *cliGenReqDNS,
+			ReportIntervalSec:  *cliGenReqRep,
 		}
 		curl, err := client.NewCurlWithConfig(&curlCfg, metric, ev)
 		if err != nil {
-			log.Printf("ERROR unable to create the client: %v\n", err)
+			log.Fatalf("ERROR unable to create the client: %v\n", err)
+		}
+
+		if *cliGenReqRPS > 0 {
+			lg, err := client.NewLoadGenerator(&client.LoadOptions{
+				RPS:               *cliGenReqRPS,
+				Concurrency:       *cliGenReqCon,
+				DurationSec:       *cliGenReqDur,
+				RampUpSec:         *cliGenReqRUp,
+				RampDownSec:       *cliGenReqRDn,
+				ReportIntervalSec: *cliGenReqRep,
+			}, curl, metric, ev)
+			if err != nil {
+				log.Fatal(err)
+			}
+			go lg.Start()
+		} else {
+			go curl.Loop(false, nil)
+		}
+	}
+
+	// Start the persistent TCP connections, and measure the
+	// connection lifetimes.
+	if *cliGenTCPTo != "" {
+		tcpCfg := client.TCPClientOptions{
+			Address:      *cliGenTCPTo,
+			TLS:          *cliGenTCPTLS,
+			Connections:  *cliGenTCPCon,
+			IntervalMs:   *cliGenTCPInt,
+			TimeoutSec:   *cliGenTCPTmo,
+			SlowStartSec: *cliGenReqSS,
+			BackoffMaxMs: *cliGenTCPBck,
+		}
+		tcpCli, err := client.NewTCPClientWithConfig(&tcpCfg, metric, ev)
+		if err != nil {
+			log.Printf("ERROR unable to create the TCP client: %v\n", err)
+		} else {
+			go tcpCli.Start()
 		}
-		go curl.Loop(false, nil)
 	}
 
 	<-readyToShutdown
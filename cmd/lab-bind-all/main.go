@@ -213,7 +213,7 @@ func main() {
 	http.HandleFunc("/readyz", HealthyHandler)
 
 	// Handle sigterm and await termChan signal
-	termChan := make(chan os.Signal)
+	termChan := make(chan os.Signal, 1)
 	signal.Notify(termChan, syscall.SIGTERM)
 
 	go func() {
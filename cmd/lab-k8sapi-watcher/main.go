@@ -1,111 +1,180 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
-	"syscall"
+	"strconv"
+	"strings"
 	"time"
 
 	flag "github.com/spf13/pflag"
 
+	"github.com/mtulio/go-lab-api/internal/client"
 	"github.com/mtulio/go-lab-api/internal/event"
+	"github.com/mtulio/go-lab-api/internal/flagutil"
 	"github.com/mtulio/go-lab-api/internal/metric"
+	"github.com/mtulio/go-lab-api/internal/server"
 	"github.com/mtulio/go-lab-api/internal/watcher"
 )
 
 var (
-	watchTg  *string = flag.String("target-group-arn", "", "Target Group ARN")
-	endpoint *string = flag.String("endpoint", "https://localhost:6443/readyz", "k8s-api healthy endpoint")
-	logPath  *string = flag.String("log-path", "", "help message for flagname")
+	watchTg   *string = flag.String("target-group-arn", "", "Comma-separated target group or load balancer ARNs, the load balancers are resolved to all their target groups.")
+	replay    *string = flag.String("target-replay", "", "Fake target group backend to run offline, used instead of the ARN: JSON lines file replaying recorded target states, or HTTP URL returning the current targets.")
+	watchInt  *uint64 = flag.Uint64("target-group-interval", 1, "Interval (seconds) to describe the target group health, errors are retried with backoff.")
+	rateLimit *uint64 = flag.Uint64("target-group-rate-limit", 5, "Maximum describe calls per second, shared by all the target groups. 0 is to use the default, the limit can't be disabled.")
+	awsRegion *string = flag.String("aws-region", "", "AWS region of the target groups. Default is the ambient configuration (AWS_REGION, shared config).")
+	awsProf   *string = flag.String("aws-profile", "", "AWS shared config profile.")
+	awsRole   *string = flag.String("aws-role-arn", "", "ARN of the role assumed to describe the target groups.")
+	awsSess   *string = flag.String("aws-role-session-name", "go-lab-api-watcher", "Session name of the assumed role.")
+	awsURL    *string = flag.String("aws-endpoint", "", "Custom ELBv2 endpoint URL, eg: a local emulator (LocalStack or moto) http://localhost:4566.")
+	endpoint  *string = flag.String("endpoint", "https://localhost:6443/readyz", "k8s-api healthy endpoint")
+	logPath   *string = flag.String("log-path", "", "help message for flagname")
+	interval  *uint64 = flag.Uint64("interval", 1000, "Interval between each request to the endpoint (milisseconds).")
+	slowStart *uint8  = flag.Uint8("slow-start", 10, "Amount of time in seconds to wait to send the first request.")
+	timeout   *uint8  = flag.Uint8("timeout", 5, "Context timeout for each request (seconds).")
+	okCodes   *string = flag.String("success-codes", "200-399", "Comma-separated status codes or ranges of a healthy response. Eg: 200,202-204")
+	bodyMatch *string = flag.String("body-match", "", "Regular expression the body of a healthy response must match.")
+	bodyExact *string = flag.String("body-exact", "", "Exact body of a healthy response, surrounding spaces are ignored. Eg: ok")
+	headers   *string = flag.String("headers", "", "Comma-separated headers a healthy response must have, in the format Name or Name=value.")
+	jsonField *string = flag.String("json-fields", "", "Comma-separated JSON fields a healthy response must have, in the format path or path=value. Eg: status=ok")
+	latencyMs *uint64 = flag.Uint64("max-latency", 0, "Maximum latency of a healthy response (milisseconds), 0 is disabled.")
+	termTime  *uint64 = flag.Uint64("termination-timeout", 120, "Time (seconds) to wait the health check to fail after the termination signal, the termination is finished by the next healthy response when the failure was shorter than the interval.")
+	verbose   *bool   = flag.Bool("readyz-verbose", false, "Request the verbose output of the endpoint, reporting the transitions of each check. Eg: [-]shutdown failed. The body assertions are checked on the verbose output.")
+
+	// repeatable flag, the sink options have commas
+	eventSinks *[]string = flag.StringArray("event-sink", nil, "Event sink, repeat to fan out the events to several sinks: stderr, stdout, file:///path?max-size=MB&max-age=24h&max-backups=N, syslog+udp://host:514, syslog+tcp://host:601, syslog+unix:///dev/log, https://url?batch=100&flush=1s&retries=3. The option types=runtime,request filters the event types of a sink. Default is stderr, or the --log-path file.")
 )
 
-func init() {
+// parseFlags parses and validates the flags, it runs on main so
+// the tests of the package don't parse the test flags.
+func parseFlags() {
 	flag.Parse()
-	if *endpoint == "" {
-		fmt.Println("Target Group ARN must be set: --target-group-arn")
+	if *replay != "" {
+		return
+	}
+	if *watchTg == "" {
+		fmt.Println("Target Group ARN must be set: --target-group-arn or --target-replay")
 		os.Exit(1)
 	}
-}
-
-// Start register when termination start. Should be called when
-// the signal is sent to k8s-apiserver.
-func signalHandler(m *metric.MetricsHandler, e *event.EventHandler) {
-	for {
-		msg := ("Running Signal handler")
-		e.Send("runtime", "hc-controller", msg)
-
-		termChan := make(chan os.Signal)
-		signal.Notify(termChan, syscall.SIGTERM)
-
-		<-termChan
-
-		msg = ("Termination Signal receievd")
-		e.Send("runtime", "k8s-watcher-signal", msg)
-
-		m.AppTermination = true
-
-		termChan = make(chan os.Signal)
-		signal.Notify(termChan, syscall.SIGTERM)
+	for _, arn := range flagutil.SplitList(*watchTg) {
+		if !strings.HasPrefix(arn, "arn:") ||
+			!(strings.Contains(arn, ":targetgroup/") || strings.Contains(arn, ":loadbalancer/")) {
+			fmt.Printf("Target Group or Load Balancer ARN is invalid: %s\n", arn)
+			os.Exit(1)
+		}
 	}
 }
 
 func main() {
+	parseFlags()
 	appName := "k8sapi-watcher"
-	e := event.NewEventHandler(appName, *logPath)
+	e, err := event.NewEventHandlerWithSinks(appName, event.SinkSpecs(*eventSinks, *logPath))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer e.Close()
 	m := metric.NewMetricHandler(e)
 
-	// set defaults
-	m.AppHealthy = false
-	m.AppTermination = false
-	m.TargetHealthy = false
+	// track the termination of the apiserver, started when the
+	// signal is sent to k8s-apiserver.
+	tracker := server.NewTerminationTracker(&server.TerminationTrackerOpts{
+		Event:  e,
+		Metric: m,
 
-	// start signal handler
-	go signalHandler(m, e)
+		TerminatingTimeout: time.Duration(*termTime) * time.Second,
+	})
+	go tracker.Start()
 
 	// Start metrics dumper/pusher
 	go m.StartPusher()
 
+	// the watcher API calls are canceled when the app is interrupted,
+	// the termination signals are tracked
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	// the self target is the apiserver port of the endpoint
+	var selfPort int64
+	if u, err := url.Parse(*endpoint); err == nil {
+		selfPort, _ = strconv.ParseInt(u.Port(), 10, 64)
+	}
+
 	// start watching target group to extract metrics
-	// dry-run / run locally
-	if *watchTg != "" {
-		tgw, err := watcher.NewTargetGroupWatcher(&watcher.TGWatcherOptions{
-			ARN:    *watchTg,
-			Metric: m,
-		})
+	tgw, err := watcher.NewTargetWatcher(&watcher.TGWatcherOptions{
+		Context:  ctx,
+		ARNs:     flagutil.SplitList(*watchTg),
+		Replay:   *replay,
+		Interval: time.Duration(*watchInt) * time.Second,
+		Metric:   m,
+		Event:    e,
+		AppState: tracker.Subscribe(),
+
+		RateLimit: float64(*rateLimit),
+		SelfPort:  selfPort,
+		AWS: watcher.AWSOptions{
+			Region:          *awsRegion,
+			Profile:         *awsProf,
+			RoleARN:         *awsRole,
+			RoleSessionName: *awsSess,
+			Endpoint:        *awsURL,
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	go tgw.Start()
+
+	// follow the individual checks of the verbose output
+	checks := &readyzChecks{
+		m:       m,
+		e:       e,
+		tracker: tracker,
+		checks:  make(map[string]bool),
+	}
+	if *verbose {
+		*endpoint, err = verboseEndpoint(*endpoint)
 		if err != nil {
 			log.Fatal(err)
 		}
-		go tgw.Start()
 	}
 
-	// start apiserver client requests
-	//> slow start
-	e.Send("request-client", appName, "Starting client in 10s")
-	time.Sleep(10 * time.Second)
-	for {
-		tlsCfg := tls.Config{InsecureSkipVerify: true}
-		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tlsCfg
-
-		resp, err := http.Get(*endpoint)
-		if err != nil {
-			msg := fmt.Sprintf("ERROR received from server. Delaying 10s: %s", err)
-			e.Send("request-client", appName, msg)
-			time.Sleep(10 * time.Second)
-			continue
+	// start apiserver client requests, the errors are retried
+	// on the same interval.
+	curl, err := client.NewCurlWithConfig(&client.CurlOptions{
+		Endpoint:     *endpoint,
+		IntervalMs:   *interval,
+		TimeoutSec:   *timeout,
+		SlowStartSec: *slowStart,
+		BackoffMinMs: *interval,
+		BackoffMaxMs: *interval,
+		Assert: &client.AssertOptions{
+			StatusCodes:  *okCodes,
+			BodyRegex:    *bodyMatch,
+			BodyExact:    *bodyExact,
+			Headers:      flagutil.SplitList(*headers),
+			JSONFields:   flagutil.SplitList(*jsonField),
+			MaxLatencyMs: *latencyMs,
+		},
+	}, m, e)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// the failed assertions are logged and counted by the client
+	go curl.Loop(true, func(resp *http.Response, err error) {
+		if *verbose {
+			checks.observe(resp)
 		}
-
-		m.AppHealthy = (resp.StatusCode >= 200 && resp.StatusCode < 400)
-
-		// make sure that termination flag will be clear when termination
-		// was in progress and the App is operational
-		if (m.AppTermination == true) && (m.AppHealthy == true) {
-			m.AppTermination = !(m.AppHealthy)
+		tracker.Observe(err == nil)
+		if resp != nil {
+			m.Inc("requests_hc")
 		}
-		m.Inc("requests_hc")
-		time.Sleep(1 * time.Second)
-	}
+	})
+
+	<-ctx.Done()
+	e.Send("runtime", appName, "Interrupted, exiting.")
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/mtulio/go-lab-api/internal/event"
+	"github.com/mtulio/go-lab-api/internal/metric"
+	"github.com/mtulio/go-lab-api/internal/server"
+)
+
+// checkLine is one check of the verbose readiness output,
+// eg: [+]etcd ok, [-]shutdown failed: reason withheld
+var checkLine = regexp.MustCompile(`^\[([+-])\](\S+)\s*(.*)$`)
+
+// readyzChecks follows the individual checks of the kube-apiserver
+// verbose readiness endpoint, reporting each check transition with
+// the termination state, so the check which flipped first is known.
+type readyzChecks struct {
+	m       *metric.MetricsHandler
+	e       *event.EventHandler
+	tracker *server.TerminationTracker
+	checks  map[string]bool
+}
+
+// ReadyzCheckEvent is sent when a readiness check changes.
+type ReadyzCheckEvent struct {
+	Check    string `json:"check"`
+	Healthy  bool   `json:"healthy"`
+	Detail   string `json:"detail"`
+	AppState string `json:"app_state"`
+}
+
+// verboseEndpoint returns the endpoint requesting the verbose output.
+func verboseEndpoint(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	if _, ok := q["verbose"]; !ok {
+		q.Set("verbose", "")
+		u.RawQuery = strings.TrimSuffix(q.Encode(), "=")
+	}
+	return u.String(), nil
+}
+
+// parseReadyzChecks returns the state and the detail of each check
+// listed on the body.
+func parseReadyzChecks(body []byte) (map[string]bool, map[string]string) {
+	checks := make(map[string]bool)
+	details := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		match := checkLine.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if match == nil {
+			continue
+		}
+		checks[match[2]] = match[1] == "+"
+		details[match[2]] = match[3]
+	}
+	return checks, details
+}
+
+// observe parses the checks of the response, the body is restored
+// so it can be read again.
+func (rc *readyzChecks) observe(resp *http.Response) {
+	if resp == nil {
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{bytes.NewReader(body), resp.Body}
+	if err != nil {
+		return
+	}
+
+	checks, details := parseReadyzChecks(body)
+	for name, healthy := range checks {
+		rc.m.SetAppCheck(name, healthy)
+		prev, seen := rc.checks[name]
+		rc.checks[name] = healthy
+		// the first time only the failed checks are reported
+		if (seen && prev == healthy) || (!seen && healthy) {
+			continue
+		}
+
+		ev := ReadyzCheckEvent{
+			Check:    name,
+			Healthy:  healthy,
+			Detail:   details[name],
+			AppState: rc.tracker.GetState().String(),
+		}
+		data, _ := json.Marshal(&ev)
+		rc.e.Send("runtime", "readyz-checks", string(data))
+	}
+}
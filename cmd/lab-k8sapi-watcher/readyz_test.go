@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVerboseEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		expected string
+	}{
+		{"https://localhost:6443/readyz", "https://localhost:6443/readyz?verbose"},
+		{"https://localhost:6443/readyz?verbose", "https://localhost:6443/readyz?verbose"},
+		{"https://localhost:6443/readyz?verbose=1", "https://localhost:6443/readyz?verbose=1"},
+		{"https://localhost:6443/readyz?exclude=etcd", "https://localhost:6443/readyz?exclude=etcd&verbose"},
+	}
+	for _, tt := range tests {
+		got, err := verboseEndpoint(tt.endpoint)
+		if err != nil {
+			t.Errorf("%s: %v", tt.endpoint, err)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("%s: got %s, expected %s", tt.endpoint, got, tt.expected)
+		}
+	}
+
+	if _, err := verboseEndpoint("https://localhost:6443/%zz"); err == nil {
+		t.Errorf("invalid endpoint was accepted")
+	}
+}
+
+func TestParseReadyzChecks(t *testing.T) {
+	body := []byte(`[+]ping ok
+[+]etcd ok
+  [-]shutdown failed: reason withheld
+[+]poststarthook/start-kube-aggregator-informers ok
+readyz check failed
+`)
+	checks, details := parseReadyzChecks(body)
+
+	expected := map[string]bool{
+		"ping":     true,
+		"etcd":     true,
+		"shutdown": false,
+		"poststarthook/start-kube-aggregator-informers": true,
+	}
+	if !reflect.DeepEqual(checks, expected) {
+		t.Errorf("got checks %v, expected %v", checks, expected)
+	}
+	if details["shutdown"] != "failed: reason withheld" {
+		t.Errorf("got shutdown detail %q", details["shutdown"])
+	}
+	if details["ping"] != "ok" {
+		t.Errorf("got ping detail %q", details["ping"])
+	}
+
+	checks, _ = parseReadyzChecks([]byte("ok"))
+	if len(checks) != 0 {
+		t.Errorf("got checks %v of the plain output", checks)
+	}
+}
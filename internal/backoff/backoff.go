@@ -0,0 +1,50 @@
+package backoff
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff is an exponential backoff with jitter, the delay is doubled
+// on each failure until the maximum, and restored on success.
+type Backoff struct {
+	min     time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+func New(minMs, maxMs uint64) *Backoff {
+	if minMs == 0 {
+		minMs = 100
+	}
+	if maxMs < minMs {
+		maxMs = minMs
+	}
+	return &Backoff{
+		min:     time.Duration(minMs) * time.Millisecond,
+		max:     time.Duration(maxMs) * time.Millisecond,
+		current: time.Duration(minMs) * time.Millisecond,
+	}
+}
+
+// Next returns the delay to wait, between half and the full
+// current backoff, and doubles the current backoff.
+func (b *Backoff) Next() time.Duration {
+	delay := b.current/2 + time.Duration(rand.Int63n(int64(b.current/2)+1))
+	b.current *= 2
+	if b.current > b.max {
+		b.current = b.max
+	}
+	return delay
+}
+
+// Reset restores the backoff to the minimum.
+func (b *Backoff) Reset() {
+	b.current = b.min
+}
+
+// Skip sets the current backoff to the maximum, for the
+// failures not expected to recover soon.
+func (b *Backoff) Skip() {
+	b.current = b.max
+}
@@ -0,0 +1,243 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of assertion failures, counted on metrics.
+const (
+	AssertStatus  = "status"
+	AssertBody    = "body"
+	AssertHeader  = "header"
+	AssertJSON    = "json"
+	AssertLatency = "latency"
+)
+
+// maxAssertBody is the maximum body size read to run the assertions.
+const maxAssertBody = 1 << 20
+
+// AssertOptions are the conditions a response must meet to be
+// counted as a success.
+type AssertOptions struct {
+	// Comma-separated status codes or ranges. Eg: 200,202-204
+	StatusCodes string
+
+	// Regular expression the body must match.
+	BodyRegex string
+
+	// Exact body, surrounding spaces are ignored. Eg: ok
+	BodyExact string
+
+	// Required headers, in the format Name or Name=value.
+	Headers []string
+
+	// JSON fields of the body, in the format path or path=value,
+	// the path is dot-separated. Eg: status=ok, data.ready=true
+	JSONFields []string
+
+	// Maximum latency (milliseconds) of the response, 0 is disabled.
+	MaxLatencyMs uint64
+}
+
+// AssertionError is the error of a response which does not meet
+// the assertions.
+type AssertionError struct {
+	Failures []AssertFailure
+}
+
+// AssertFailure is one failed assertion.
+type AssertFailure struct {
+	Kind   string `json:"kind"`
+	Reason string `json:"reason"`
+}
+
+func (e *AssertionError) Error() string {
+	reasons := []string{}
+	for _, f := range e.Failures {
+		reasons = append(reasons, f.Reason)
+	}
+	return "assertion failed: " + strings.Join(reasons, "; ")
+}
+
+type assertions struct {
+	codes      [][2]int
+	body       *regexp.Regexp
+	bodyExact  string
+	headers    [][2]string
+	jsonFields [][2]string
+	maxLatency time.Duration
+}
+
+func newAssertions(op *AssertOptions) (*assertions, error) {
+	a := assertions{
+		bodyExact:  strings.TrimSpace(op.BodyExact),
+		maxLatency: time.Duration(op.MaxLatencyMs) * time.Millisecond,
+	}
+	if op.StatusCodes != "" {
+		codes, err := parseStatusCodes(op.StatusCodes)
+		if err != nil {
+			return nil, err
+		}
+		a.codes = codes
+	}
+	if op.BodyRegex != "" {
+		re, err := regexp.Compile(op.BodyRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid body regex: %v", err)
+		}
+		a.body = re
+	}
+	for _, h := range op.Headers {
+		a.headers = append(a.headers, splitKeyValue(h))
+	}
+	for _, f := range op.JSONFields {
+		a.jsonFields = append(a.jsonFields, splitKeyValue(f))
+	}
+	return &a, nil
+}
+
+// parseStatusCodes parses the comma-separated status codes,
+// individual or ranges.
+func parseStatusCodes(codes string) ([][2]int, error) {
+	ranges := [][2]int{}
+	for _, c := range strings.Split(codes, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(c), "-", 2)
+		if len(bounds) == 1 {
+			bounds = append(bounds, bounds[0])
+		}
+		min, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid status code [%s]", c)
+		}
+		max, err := strconv.Atoi(bounds[1])
+		if err != nil || max < min {
+			return nil, fmt.Errorf("invalid status code range [%s]", c)
+		}
+		ranges = append(ranges, [2]int{min, max})
+	}
+	return ranges, nil
+}
+
+func splitKeyValue(kv string) [2]string {
+	parts := strings.SplitN(kv, "=", 2)
+	if len(parts) == 1 {
+		return [2]string{strings.TrimSpace(parts[0]), ""}
+	}
+	return [2]string{strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])}
+}
+
+func (a *assertions) needBody() bool {
+	return a.body != nil || a.bodyExact != "" || len(a.jsonFields) > 0
+}
+
+// check returns the error of the response which does not meet the
+// assertions. The body is read and restored, so it can be read again.
+func (a *assertions) check(resp *http.Response, latency time.Duration) *AssertionError {
+	failures := []AssertFailure{}
+	fail := func(kind, format string, args ...interface{}) {
+		failures = append(failures, AssertFailure{Kind: kind, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	if len(a.codes) > 0 {
+		codeOK := false
+		for _, c := range a.codes {
+			if resp.StatusCode >= c[0] && resp.StatusCode <= c[1] {
+				codeOK = true
+				break
+			}
+		}
+		if !codeOK {
+			fail(AssertStatus, "unexpected status code %d", resp.StatusCode)
+		}
+	}
+
+	for _, h := range a.headers {
+		values, ok := resp.Header[http.CanonicalHeaderKey(h[0])]
+		switch {
+		case !ok:
+			fail(AssertHeader, "missing header %s", h[0])
+		case h[1] != "" && values[0] != h[1]:
+			fail(AssertHeader, "header %s is %q, expected %q", h[0], values[0], h[1])
+		}
+	}
+
+	if a.needBody() {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxAssertBody))
+		resp.Body = &replayBody{Reader: bytes.NewReader(body), body: resp.Body}
+		if err != nil {
+			fail(AssertBody, "unable to read the body: %v", err)
+		} else {
+			a.checkBody(body, fail)
+		}
+	}
+
+	if a.maxLatency > 0 && latency > a.maxLatency {
+		fail(AssertLatency, "latency %dms is greater than %dms", latency.Milliseconds(), a.maxLatency.Milliseconds())
+	}
+
+	if len(failures) == 0 {
+		return nil
+	}
+	return &AssertionError{Failures: failures}
+}
+
+func (a *assertions) checkBody(body []byte, fail func(kind, format string, args ...interface{})) {
+	if a.body != nil && !a.body.Match(body) {
+		fail(AssertBody, "body does not match %q", a.body.String())
+	}
+	if a.bodyExact != "" && strings.TrimSpace(string(body)) != a.bodyExact {
+		fail(AssertBody, "body is not %q", a.bodyExact)
+	}
+	if len(a.jsonFields) == 0 {
+		return
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		fail(AssertJSON, "body is not JSON: %v", err)
+		return
+	}
+	for _, f := range a.jsonFields {
+		value, ok := jsonField(doc, f[0])
+		switch {
+		case !ok:
+			fail(AssertJSON, "missing JSON field %s", f[0])
+		case f[1] != "" && fmt.Sprint(value) != f[1]:
+			fail(AssertJSON, "JSON field %s is %v, expected %s", f[0], value, f[1])
+		}
+	}
+}
+
+// jsonField returns the value of the dot-separated path.
+func jsonField(doc interface{}, path string) (interface{}, bool) {
+	value := doc
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = obj[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// replayBody returns the body read by the assertions, closing the
+// original body.
+type replayBody struct {
+	*bytes.Reader
+	body io.ReadCloser
+}
+
+func (b *replayBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStatusCodes(t *testing.T) {
+	tests := []struct {
+		codes    string
+		expected string
+		err      bool
+	}{
+		{"200", "[[200 200]]", false},
+		{"200,202-204", "[[200 200] [202 204]]", false},
+		{" 200 , 300-399 ", "[[200 200] [300 399]]", false},
+		{"204-204", "[[204 204]]", false},
+		{"abc", "", true},
+		{"200-", "", true},
+		{"-200", "", true},
+		{"204-202", "", true},
+		{"200,", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseStatusCodes(tt.codes)
+		if tt.err {
+			if err == nil {
+				t.Errorf("codes %q: got %v, expected an error", tt.codes, got)
+			}
+			continue
+		}
+		if err != nil || fmt.Sprint(got) != tt.expected {
+			t.Errorf("codes %q: got %v, error %v, expected %s", tt.codes, got, err, tt.expected)
+		}
+	}
+}
+
+func TestSplitKeyValue(t *testing.T) {
+	tests := []struct {
+		kv       string
+		expected [2]string
+	}{
+		{"X-Instance-Id", [2]string{"X-Instance-Id", ""}},
+		{"Content-Type=application/json", [2]string{"Content-Type", "application/json"}},
+		{" status = ok ", [2]string{"status", "ok"}},
+		{"data.url=http://host/?a=b", [2]string{"data.url", "http://host/?a=b"}},
+		{"status=", [2]string{"status", ""}},
+	}
+	for _, tt := range tests {
+		if got := splitKeyValue(tt.kv); got != tt.expected {
+			t.Errorf("%q: got %q, expected %q", tt.kv, got, tt.expected)
+		}
+	}
+}
+
+func TestAssertions(t *testing.T) {
+	tests := []struct {
+		name    string
+		op      AssertOptions
+		status  int
+		headers map[string]string
+		body    string
+		latency time.Duration
+		// kinds of the failures, empty is a success
+		failures []string
+	}{
+		{"status in range", AssertOptions{StatusCodes: "200,202-204"}, 204, nil, "", 0, nil},
+		{"status lower bound", AssertOptions{StatusCodes: "200,202-204"}, 202, nil, "", 0, nil},
+		{"status between codes", AssertOptions{StatusCodes: "200,202-204"}, 201, nil, "", 0, []string{AssertStatus}},
+		{"status above range", AssertOptions{StatusCodes: "200,202-204"}, 205, nil, "", 0, []string{AssertStatus}},
+		{"body exact trimmed", AssertOptions{BodyExact: " ok\n"}, 200, nil, "ok\n", 0, nil},
+		{"body exact", AssertOptions{BodyExact: "ok"}, 200, nil, "okay", 0, []string{AssertBody}},
+		{"body regex", AssertOptions{BodyRegex: `\[\+\]etcd ok`}, 200, nil, "[+]ping ok\n[+]etcd ok\n", 0, nil},
+		{"body regex mismatch", AssertOptions{BodyRegex: `^ok$`}, 200, nil, "failed", 0, []string{AssertBody}},
+		{"header present", AssertOptions{Headers: []string{"x-instance-id"}}, 200, map[string]string{"X-Instance-Id": "a"}, "", 0, nil},
+		{"header missing", AssertOptions{Headers: []string{"X-Instance-Id"}}, 200, nil, "", 0, []string{AssertHeader}},
+		{"header value", AssertOptions{Headers: []string{"Content-Type=application/json"}}, 200, map[string]string{"Content-Type": "application/json"}, "", 0, nil},
+		{"header wrong value", AssertOptions{Headers: []string{"Content-Type=application/json"}}, 200, map[string]string{"Content-Type": "text/plain"}, "", 0, []string{AssertHeader}},
+		{"json field", AssertOptions{JSONFields: []string{"status=ok"}}, 200, nil, `{"status": "ok"}`, 0, nil},
+		{"json nested fields", AssertOptions{JSONFields: []string{"data.ready=true", "data.replicas=3", "data.name"}}, 200, nil, `{"data": {"ready": true, "replicas": 3, "name": "a"}}`, 0, nil},
+		{"json wrong value", AssertOptions{JSONFields: []string{"data.ready=true"}}, 200, nil, `{"data": {"ready": false}}`, 0, []string{AssertJSON}},
+		{"json missing field", AssertOptions{JSONFields: []string{"data.ready"}}, 200, nil, `{"data": {}}`, 0, []string{AssertJSON}},
+		{"json path through a value", AssertOptions{JSONFields: []string{"status.ready"}}, 200, nil, `{"status": "ok"}`, 0, []string{AssertJSON}},
+		{"json invalid body", AssertOptions{JSONFields: []string{"status"}}, 200, nil, `ok`, 0, []string{AssertJSON}},
+		{"latency", AssertOptions{MaxLatencyMs: 100}, 200, nil, "", 100 * time.Millisecond, nil},
+		{"latency exceeded", AssertOptions{MaxLatencyMs: 100}, 200, nil, "", 101 * time.Millisecond, []string{AssertLatency}},
+		{"several failures", AssertOptions{StatusCodes: "200", BodyExact: "ok"}, 500, nil, "failed", 0, []string{AssertStatus, AssertBody}},
+	}
+	for _, tt := range tests {
+		a, err := newAssertions(&tt.op)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		resp := &http.Response{
+			StatusCode: tt.status,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader(tt.body)),
+		}
+		for k, v := range tt.headers {
+			resp.Header.Set(k, v)
+		}
+		kinds := []string{}
+		if aerr := a.check(resp, tt.latency); aerr != nil {
+			for _, f := range aerr.Failures {
+				kinds = append(kinds, f.Kind)
+			}
+		}
+		if fmt.Sprint(kinds) != fmt.Sprint(tt.failures) {
+			t.Errorf("%s: got failures %v, expected %v", tt.name, kinds, tt.failures)
+		}
+		// the body can be read again after the assertions
+		if body, _ := io.ReadAll(resp.Body); string(body) != tt.body {
+			t.Errorf("%s: got body %q after the assertions, expected %q", tt.name, body, tt.body)
+		}
+	}
+}
+
+func TestNewAssertionsErrors(t *testing.T) {
+	for _, op := range []AssertOptions{
+		{StatusCodes: "2xx"},
+		{BodyRegex: "("},
+	} {
+		if _, err := newAssertions(&op); err == nil {
+			t.Errorf("options %+v were accepted", op)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mtulio/go-lab-api/internal/header"
+)
+
+// BackendStats are the responses served by one backend instance,
+// identified by the instance header. The last seen time shows when
+// the traffic to a draining target has stopped.
+type BackendStats struct {
+	Requests  uint64            `json:"requests"`
+	Status    map[string]uint64 `json:"status"`
+	RemoteIP  string            `json:"remote_ip"`
+	FirstSeen time.Time         `json:"first_seen"`
+	LastSeen  time.Time         `json:"last_seen"`
+}
+
+// backendTracker keeps the stats of the backends which
+// answered the client.
+type backendTracker struct {
+	locker   sync.Mutex
+	backends map[string]*BackendStats
+}
+
+func newBackendTracker() *backendTracker {
+	return &backendTracker{
+		backends: make(map[string]*BackendStats),
+	}
+}
+
+// backendID returns the instance which served the response,
+// empty when the server does not identify itself.
+func backendID(resp *http.Response) string {
+	if resp == nil {
+		return ""
+	}
+	return resp.Header.Get(header.InstanceID)
+}
+
+// observe registers the response of the backend, returning
+// true when the backend is seen for the first time.
+func (bt *backendTracker) observe(id, class, remoteIP string) bool {
+	now := time.Now()
+	bt.locker.Lock()
+	defer bt.locker.Unlock()
+
+	b, ok := bt.backends[id]
+	if !ok {
+		b = &BackendStats{
+			Status:    make(map[string]uint64),
+			FirstSeen: now,
+		}
+		bt.backends[id] = b
+	}
+	b.Requests += 1
+	b.Status[class] += 1
+	b.RemoteIP = remoteIP
+	b.LastSeen = now
+	return !ok
+}
+
+// snapshot returns a copy of the backend stats.
+func (bt *backendTracker) snapshot() map[string]BackendStats {
+	bt.locker.Lock()
+	defer bt.locker.Unlock()
+
+	snap := make(map[string]BackendStats, len(bt.backends))
+	for id, b := range bt.backends {
+		st := *b
+		st.Status = make(map[string]uint64, len(b.Status))
+		for class, count := range b.Status {
+			st.Status[class] = count
+		}
+		snap[id] = st
+	}
+	return snap
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mtulio/go-lab-api/internal/header"
+)
+
+// newBackend returns the server identified as the instance, empty
+// is a server which does not identify itself.
+func newBackend(t *testing.T, instance string, status int) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if instance != "" {
+			w.Header().Set(header.InstanceID, instance)
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestBackendAttribution(t *testing.T) {
+	a := newBackend(t, "instance-a", http.StatusOK)
+	b := newBackend(t, "instance-b", http.StatusServiceUnavailable)
+	anonymous := newBackend(t, "", http.StatusOK)
+
+	// round robin: a, b, anonymous, a, b, anonymous, a
+	c, logPath := newTestCurl(t, &CurlOptions{
+		Endpoints:  []string{a.URL, b.URL, anonymous.URL},
+		TimeoutSec: 1,
+		Count:      7,
+	})
+	c.Loop(false, nil)
+
+	msgs := readMessages(t, logPath, "curl")
+	summary := CurlSummary{}
+	if err := json.Unmarshal([]byte(msgs[len(msgs)-1]), &summary); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		backend  string
+		requests uint64
+		class    string
+	}{
+		{"instance-a", 3, "2xx"},
+		{"instance-b", 2, "5xx"},
+	}
+	if len(summary.Backends) != len(tests) {
+		t.Errorf("got backends %v, expected %d", summary.Backends, len(tests))
+	}
+	for _, tt := range tests {
+		st, ok := summary.Backends[tt.backend]
+		switch {
+		case !ok:
+			t.Errorf("backend %s not reported", tt.backend)
+		case st.Requests != tt.requests || st.Status[tt.class] != tt.requests:
+			t.Errorf("backend %s: got %d requests, status %v, expected %d %s", tt.backend, st.Requests, st.Status, tt.requests, tt.class)
+		case st.RemoteIP != "127.0.0.1" || st.FirstSeen.IsZero() || st.LastSeen.Before(st.FirstSeen):
+			t.Errorf("backend %s: got remote IP %s, first seen %s, last seen %s", tt.backend, st.RemoteIP, st.FirstSeen, st.LastSeen)
+		}
+	}
+	if ip := summary.IPs["127.0.0.1"]; ip.Requests != 7 {
+		t.Errorf("got %d requests to the IP, expected 7", ip.Requests)
+	}
+
+	// the new backends are reported once
+	news := 0
+	for _, msg := range msgs {
+		if msg == "New backend instance-a answering from 127.0.0.1" || msg == "New backend instance-b answering from 127.0.0.1" {
+			news += 1
+		}
+	}
+	if news != 2 {
+		t.Errorf("got %d new backend events, expected 2", news)
+	}
+}
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"syscall"
+)
+
+// Error classes of failed requests.
+const (
+	ErrClassDNS            = "dns"
+	ErrClassConnectRefused = "connect_refused"
+	ErrClassConnectTimeout = "connect_timeout"
+	ErrClassTLSHandshake   = "tls_handshake"
+	ErrClassConnReset      = "conn_reset"
+	ErrClassReadTimeout    = "read_timeout"
+	ErrClassOther          = "other"
+)
+
+// requestTrace registers the progress of one request, used to
+// classify the failures and to report the remote IP.
+type requestTrace struct {
+	endpoint string
+
+	locker     sync.Mutex
+	remoteAddr string
+	connected  bool
+	tlsStarted bool
+	tlsDone    bool
+}
+
+func (rt *requestTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		ConnectDone: func(network, addr string, err error) {
+			rt.locker.Lock()
+			rt.remoteAddr = addr
+			rt.locker.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			rt.locker.Lock()
+			rt.tlsStarted = true
+			rt.locker.Unlock()
+		},
+		TLSHandshakeDone: func(cs tls.ConnectionState, err error) {
+			rt.locker.Lock()
+			rt.tlsDone = (err == nil)
+			rt.locker.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			rt.locker.Lock()
+			rt.connected = true
+			rt.remoteAddr = info.Conn.RemoteAddr().String()
+			rt.locker.Unlock()
+		},
+	}
+}
+
+// RemoteIP returns the IP that served or failed the request.
+func (rt *requestTrace) RemoteIP() string {
+	rt.locker.Lock()
+	defer rt.locker.Unlock()
+	ip, _, err := net.SplitHostPort(rt.remoteAddr)
+	if err != nil {
+		return rt.remoteAddr
+	}
+	return ip
+}
+
+// classify returns the class of the request error.
+func (rt *requestTrace) classify(err error) string {
+	rt.locker.Lock()
+	connected, tlsStarted, tlsDone := rt.connected, rt.tlsStarted, rt.tlsDone
+	rt.locker.Unlock()
+
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	var certErr x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	var certInvalidErr x509.CertificateInvalidError
+
+	timeout := errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout())
+
+	switch {
+	case errors.As(err, &dnsErr):
+		return ErrClassDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrClassConnectRefused
+	case errors.As(err, &recordErr), errors.As(err, &certErr),
+		errors.As(err, &hostErr), errors.As(err, &certInvalidErr):
+		return ErrClassTLSHandshake
+	case tlsStarted && !tlsDone && !connected:
+		return ErrClassTLSHandshake
+	case timeout && !connected:
+		return ErrClassConnectTimeout
+	case timeout:
+		return ErrClassReadTimeout
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrClassConnReset
+	}
+	return ErrClassOther
+}
+
+// statusClass returns the class of the response status code.
+func statusClass(resp *http.Response) string {
+	switch {
+	case resp.StatusCode < 200:
+		return "1xx"
+	case resp.StatusCode < 300:
+		return "2xx"
+	case resp.StatusCode < 400:
+		return "3xx"
+	case resp.StatusCode < 500:
+		return "4xx"
+	}
+	return "5xx"
+}
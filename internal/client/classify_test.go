@@ -0,0 +1,121 @@
+package client
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// closedAddr returns a local address not listening.
+func closedAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestClassifyRequestErrors(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(1500 * time.Millisecond)
+		case "/reset":
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+		}
+	}))
+	defer plain.Close()
+	addr := strings.TrimPrefix(plain.URL, "http://")
+
+	tests := []struct {
+		name     string
+		endpoint string
+		expected string
+	}{
+		{"refused", "http://" + closedAddr(t), ErrClassConnectRefused},
+		{"dns", "http://lab-api.invalid", ErrClassDNS},
+		{"tls on a plain server", "https://" + addr, ErrClassTLSHandshake},
+		{"read timeout", plain.URL + "/slow", ErrClassReadTimeout},
+		{"reset", plain.URL + "/reset", ErrClassConnReset},
+	}
+	for _, tt := range tests {
+		c, _ := newTestCurl(t, &CurlOptions{Endpoint: tt.endpoint, TimeoutSec: 1})
+		resp, trace, err := c.request()
+		if err == nil {
+			resp.Body.Close()
+			t.Errorf("%s: request succeeded", tt.name)
+			continue
+		}
+		if got := trace.classify(err); got != tt.expected {
+			t.Errorf("%s: got class %s, expected %s: %v", tt.name, got, tt.expected, err)
+		}
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	dialTimeout := &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	tests := []struct {
+		name     string
+		err      error
+		trace    *requestTrace
+		expected string
+	}{
+		{"dns", &net.DNSError{Err: "no such host", Name: "host", IsNotFound: true}, &requestTrace{}, ErrClassDNS},
+		{"refused", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, &requestTrace{}, ErrClassConnectRefused},
+		{"connect timeout", dialTimeout, &requestTrace{}, ErrClassConnectTimeout},
+		{"context timeout while connecting", fmt.Errorf("get: %w", context.DeadlineExceeded), &requestTrace{}, ErrClassConnectTimeout},
+		{"read timeout", fmt.Errorf("get: %w", context.DeadlineExceeded), &requestTrace{connected: true}, ErrClassReadTimeout},
+		{"handshake timeout", dialTimeout, &requestTrace{tlsStarted: true}, ErrClassTLSHandshake},
+		{"unknown authority", &url.Error{Err: x509.UnknownAuthorityError{}}, &requestTrace{connected: true}, ErrClassTLSHandshake},
+		{"reset", &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, &requestTrace{connected: true}, ErrClassConnReset},
+		{"broken pipe", &net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.EPIPE)}, &requestTrace{connected: true}, ErrClassConnReset},
+		{"closed", fmt.Errorf("get: %w", io.EOF), &requestTrace{connected: true}, ErrClassConnReset},
+		{"other", errors.New("unsupported protocol scheme"), &requestTrace{}, ErrClassOther},
+	}
+	for _, tt := range tests {
+		if got := tt.trace.classify(tt.err); got != tt.expected {
+			t.Errorf("%s: got class %s, expected %s", tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestStatusClass(t *testing.T) {
+	tests := []struct {
+		code     int
+		expected string
+	}{
+		{101, "1xx"},
+		{200, "2xx"},
+		{204, "2xx"},
+		{299, "2xx"},
+		{301, "3xx"},
+		{404, "4xx"},
+		{429, "4xx"},
+		{499, "4xx"},
+		{500, "5xx"},
+		{503, "5xx"},
+	}
+	for _, tt := range tests {
+		if got := statusClass(&http.Response{StatusCode: tt.code}); got != tt.expected {
+			t.Errorf("status %d: got class %s, expected %s", tt.code, got, tt.expected)
+		}
+	}
+}
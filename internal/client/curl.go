@@ -1,19 +1,38 @@
 package client
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync/atomic"
 	"time"
 
+	"github.com/mtulio/go-lab-api/internal/backoff"
 	"github.com/mtulio/go-lab-api/internal/event"
 	"github.com/mtulio/go-lab-api/internal/metric"
 )
 
 type Curl struct {
-	cfg *CurlOptions
-	m   *metric.MetricsHandler
-	e   *event.EventHandler
+	// 64-bit atomic counters must be aligned
+	next uint64
+
+	cfg      *CurlOptions
+	m        *metric.MetricsHandler
+	e        *event.EventHandler
+	client   *http.Client
+	backends *backendTracker
+	ips      *ipTracker
+	dialer   *dialer
+	assert   *assertions
+
+	// requests are sent to the endpoints in round robin
+	endpoints []string
 }
 
 type CurlOptions struct {
@@ -22,6 +41,58 @@ type CurlOptions struct {
 	TimeoutSec   uint8
 	SlowStartSec uint8
 	Count        uint64
+	BackoffMinMs uint64
+	BackoffMaxMs uint64
+	Debug        bool
+
+	// Additional endpoints, used in round robin with Endpoint.
+	Endpoints []string
+
+	// Disable the TCP keepalive probes of the connections.
+	DisableKeepAlive bool
+
+	// Open a new connection for each request, instead of
+	// reusing the connections of the pool.
+	NewConnection bool
+
+	// Connect only to these IPs, ignoring the DNS.
+	PinIPs []string
+
+	// Resolve the endpoint hosts on the interval (seconds), 0
+	// uses the system resolver on each new connection.
+	ResolveIntervalSec uint64
+
+	// Conditions of a successful response, nil accepts any response.
+	Assert *AssertOptions
+
+	// Report the backends and IPs on the interval (seconds) while
+	// the Loop runs, 0 reports them only on the summary.
+	ReportIntervalSec uint64
+}
+
+// CurlBackendsReport is the report of the backends and IPs sent
+// on each report interval of the Loop.
+type CurlBackendsReport struct {
+	Requests uint64                  `json:"requests"`
+	Backends map[string]BackendStats `json:"backends"`
+	IPs      map[string]IPStats      `json:"ips"`
+}
+
+// CurlSummary is the report sent when the client finishes
+// the amount of requests.
+type CurlSummary struct {
+	Endpoints    []string                `json:"endpoints"`
+	Requests     uint64                  `json:"requests"`
+	Errors       uint64                  `json:"errors"`
+	ErrorClasses map[string]uint64       `json:"error_classes"`
+	Status       map[string]uint64       `json:"status"`
+	AssertFailed uint64                  `json:"assert_failed"`
+	Assertions   map[string]uint64       `json:"assert_failures"`
+	Backends     map[string]BackendStats `json:"backends"`
+	IPs          map[string]IPStats      `json:"ips"`
+	DurationMs   int64                   `json:"duration_ms"`
+	LatencyAvgMs float64                 `json:"latency_avg_ms"`
+	LatencyMaxMs float64                 `json:"latency_max_ms"`
 }
 
 func NewCurlWithConfig(
@@ -29,24 +100,191 @@ func NewCurlWithConfig(
 	m *metric.MetricsHandler,
 	e *event.EventHandler) (*Curl, error) {
 
+	endpoints := cfg.Endpoints
+	if cfg.Endpoint != "" {
+		endpoints = append([]string{cfg.Endpoint}, endpoints...)
+	}
+	if len(endpoints) == 0 {
+		return nil, errors.New("client endpoint must be set")
+	}
+
+	d := newDialer(cfg, e)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	transport.DialContext = d.DialContext
+	transport.DisableKeepAlives = cfg.NewConnection
+
 	c := Curl{
 		cfg: cfg,
 		m:   m,
 		e:   e,
+		client: &http.Client{
+			Transport: transport,
+		},
+		backends:  newBackendTracker(),
+		ips:       newIPTracker(),
+		dialer:    d,
+		endpoints: endpoints,
+	}
+	if cfg.Assert != nil {
+		a, err := newAssertions(cfg.Assert)
+		if err != nil {
+			return nil, err
+		}
+		c.assert = a
+	}
+
+	if cfg.ResolveIntervalSec > 0 && len(cfg.PinIPs) == 0 {
+		hosts := []string{}
+		for _, endpoint := range endpoints {
+			u, err := url.Parse(endpoint)
+			if err != nil {
+				return nil, err
+			}
+			hosts = append(hosts, u.Hostname())
+		}
+		go d.StartResolver(hosts)
 	}
 
 	return &c, nil
 }
 
-func (c *Curl) Go() {
-	return
+// CurlRequestEvent is the event of one request, with the
+// remote IP that served or failed it.
+type CurlRequestEvent struct {
+	Endpoint  string  `json:"endpoint"`
+	RemoteIP  string  `json:"remote_ip"`
+	Backend   string  `json:"backend,omitempty"`
+	Code      int     `json:"code,omitempty"`
+	Class     string  `json:"class"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMs float64 `json:"latency_ms"`
+
+	Assertions []AssertFailure `json:"failed_assertions,omitempty"`
+}
+
+// Go sends one request to the endpoint, the request is canceled
+// when the timeout is reached. The caller must close the body.
+func (c *Curl) Go() (*http.Response, error) {
+	resp, _, err := c.request()
+	return resp, err
+}
+
+// request sends the request tracing the connection.
+func (c *Curl) request() (*http.Response, *requestTrace, error) {
+	endpoint := c.endpoints[(atomic.AddUint64(&c.next, 1)-1)%uint64(len(c.endpoints))]
+	trace := &requestTrace{endpoint: endpoint}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if c.cfg.TimeoutSec > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(c.cfg.TimeoutSec)*time.Second)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	ctx = httptrace.WithClientTrace(ctx, trace.clientTrace())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		cancel()
+		return nil, trace, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, trace, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, trace, nil
+}
+
+// check runs the assertions on the response, returning nil when
+// the response meets them.
+func (c *Curl) check(resp *http.Response, start time.Time) *AssertionError {
+	if c.assert == nil {
+		return nil
+	}
+	return c.assert.check(resp, time.Since(start))
 }
 
-// Loop will call URL (Go) according intervalMs
-func (c *Curl) Loop(callback bool, callbackFN func(*http.Response)) {
+// record counts the request outcome on metrics, returning the
+// status class or the error class. The event is sent for errors,
+// server errors and failed assertions, or for every request in
+// debug mode.
+func (c *Curl) record(resp *http.Response, trace *requestTrace, err error, failed *AssertionError, latencyMs float64) string {
+	ev := CurlRequestEvent{
+		Endpoint:  trace.endpoint,
+		RemoteIP:  trace.RemoteIP(),
+		LatencyMs: latencyMs,
+	}
+	if err != nil {
+		ev.Class = trace.classify(err)
+		ev.Error = err.Error()
+		c.m.Inc("requests_cli_errors")
+		c.m.Inc("requests_cli_err_" + ev.Class)
+	} else {
+		ev.Class = statusClass(resp)
+		ev.Code = resp.StatusCode
+		ev.Backend = backendID(resp)
+		c.m.Inc("requests_client")
+		c.m.Inc("requests_cli_" + ev.Class)
+	}
+
+	if failed != nil {
+		ev.Assertions = failed.Failures
+		c.m.Inc("requests_cli_assert_failed")
+		for _, f := range failed.Failures {
+			c.m.Inc("requests_cli_assert_" + f.Kind)
+		}
+	}
+
+	if ipEv := c.ips.observe(ev.RemoteIP, ev.Class, err); ipEv != nil {
+		data, _ := json.Marshal(ipEv)
+		c.e.Send("request-client", "curl", string(data))
+	}
+
+	if ev.Backend != "" {
+		c.m.IncClientBackend(ev.Backend)
+		if c.backends.observe(ev.Backend, ev.Class, ev.RemoteIP) {
+			msg := fmt.Sprintf("New backend %s answering from %s", ev.Backend, ev.RemoteIP)
+			c.e.Send("request-client", "curl", msg)
+		}
+	}
+
+	if err != nil || ev.Class == "5xx" || failed != nil || c.cfg.Debug {
+		data, _ := json.Marshal(&ev)
+		c.e.Send("request-client", "curl", string(data))
+	}
+	return ev.Class
+}
+
+// cancelBody releases the request context when the body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// Loop will call URL (Go) according intervalMs, until the Count
+// of requests is reached (0 is infinite). On errors the next request
+// is delayed by the backoff. The callback receives the request error,
+// or the AssertionError when the response does not meet the assertions.
+func (c *Curl) Loop(callback bool, callbackFN func(*http.Response, error)) {
 	cfg := c.cfg
 	appName := "curl"
 	var reqCount uint64 = 0
+	var latencySum float64 = 0
+	bo := backoff.New(cfg.BackoffMinMs, cfg.BackoffMaxMs)
+	summary := CurlSummary{
+		Endpoints:    c.endpoints,
+		ErrorClasses: map[string]uint64{},
+		Status:       map[string]uint64{},
+		Assertions:   map[string]uint64{},
+	}
 
 	if c.cfg.SlowStartSec > 0 {
 		msg := fmt.Sprintf("Starting client in  %ds", c.cfg.SlowStartSec)
@@ -54,33 +292,89 @@ func (c *Curl) Loop(callback bool, callbackFN func(*http.Response)) {
 		time.Sleep(time.Duration(c.cfg.SlowStartSec) * time.Second)
 	}
 
-	for {
-		reqCount += 1
+	if cfg.ReportIntervalSec > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go c.runReporter(done)
+	}
 
-		tlsCfg := tls.Config{InsecureSkipVerify: true}
-		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tlsCfg
+	start := time.Now()
+	for cfg.Count == 0 || reqCount < cfg.Count {
+		reqCount += 1
+		summary.Requests += 1
 
-		resp, err := http.Get(cfg.Endpoint)
+		reqStart := time.Now()
+		resp, trace, err := c.request()
 		if err != nil {
-			fixedDelay := 1 // backoff
-			msg := fmt.Sprintf("ERROR received from server. Delaying %ds: %s", fixedDelay, err)
+			class := c.record(nil, trace, err, nil, float64(time.Since(reqStart).Microseconds())/1000)
+			summary.Errors += 1
+			summary.ErrorClasses[class] += 1
+			if callback {
+				callbackFN(nil, err)
+			}
+			delay := bo.Next()
+			msg := fmt.Sprintf("ERROR received from server (%s). Delaying %dms: %s", class, delay.Milliseconds(), err)
 			c.e.Send("request-client", appName, msg)
-			time.Sleep(time.Duration(fixedDelay) * time.Second)
+			time.Sleep(delay)
 			continue
 		}
+		bo.Reset()
 
-		c.m.Inc("requests_client")
-		if resp.StatusCode >= 200 && resp.StatusCode < 400 {
-			c.m.Inc("requests_cli_2xx")
-		} else if resp.StatusCode >= 400 && resp.StatusCode < 500 {
-			c.m.Inc("requests_cli_4xx")
-		} else {
-			c.m.Inc("requests_cli_5xx")
+		failed := c.check(resp, reqStart)
+		if failed != nil {
+			summary.AssertFailed += 1
+			for _, f := range failed.Failures {
+				summary.Assertions[f.Kind] += 1
+			}
 		}
 		if callback {
-			callbackFN(resp)
+			if failed != nil {
+				callbackFN(resp, failed)
+			} else {
+				callbackFN(resp, nil)
+			}
+		}
+		// drain the body to reuse the connection
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		latency := float64(time.Since(reqStart).Microseconds()) / 1000
+		summary.Status[c.record(resp, trace, nil, failed, latency)] += 1
+		latencySum += latency
+		if latency > summary.LatencyMaxMs {
+			summary.LatencyMaxMs = latency
 		}
 
 		time.Sleep(time.Duration(cfg.IntervalMs) * time.Millisecond)
 	}
+
+	summary.DurationMs = time.Since(start).Milliseconds()
+	summary.Backends = c.backends.snapshot()
+	summary.IPs = c.ips.snapshot()
+	if responses := summary.Requests - summary.Errors; responses > 0 {
+		summary.LatencyAvgMs = latencySum / float64(responses)
+	}
+	data, _ := json.Marshal(&summary)
+	c.e.Send("request-client", appName, string(data))
+}
+
+// runReporter sends the report of the backends on each interval,
+// showing the last seen time of the draining targets.
+func (c *Curl) runReporter(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(c.cfg.ReportIntervalSec) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			rep := CurlBackendsReport{
+				Requests: atomic.LoadUint64(&c.next),
+				Backends: c.backends.snapshot(),
+				IPs:      c.ips.snapshot(),
+			}
+			data, _ := json.Marshal(&rep)
+			c.e.Send("request-client", "curl", string(data))
+		}
+	}
 }
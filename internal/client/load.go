@@ -0,0 +1,268 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mtulio/go-lab-api/internal/event"
+	"github.com/mtulio/go-lab-api/internal/metric"
+)
+
+// LoadGenerator is an open-loop load generator: requests are scheduled
+// at the target rate regardless of the responses, and the latency is
+// measured from the scheduled time, so the time waiting for a free
+// worker is not omitted (coordinated omission).
+type LoadGenerator struct {
+	cfg  *LoadOptions
+	curl *Curl
+	m    *metric.MetricsHandler
+	e    *event.EventHandler
+
+	locker   sync.Mutex
+	interval loadStats
+	total    loadStats
+}
+
+type LoadOptions struct {
+	// Target requests per second on steady phase.
+	RPS         uint64
+	Concurrency uint64
+	// Duration of the steady phase, 0 is infinite.
+	DurationSec       uint64
+	RampUpSec         uint64
+	RampDownSec       uint64
+	ReportIntervalSec uint64
+}
+
+type loadStats struct {
+	start       time.Time
+	requests    uint64
+	errors      uint64
+	latencies   []float64
+	serviceTime []float64
+}
+
+// LoadReport is the report sent on each report interval, and
+// at the end of the run.
+type LoadReport struct {
+	Phase         string                  `json:"phase"`
+	TargetRPS     float64                 `json:"target_rps"`
+	AchievedRPS   float64                 `json:"achieved_rps"`
+	Requests      uint64                  `json:"requests"`
+	Errors        uint64                  `json:"errors"`
+	LatencyMs     map[string]float64      `json:"latency_ms"`
+	ServiceTimeMs map[string]float64      `json:"service_time_ms"`
+	Backends      map[string]BackendStats `json:"backends"`
+	IPs           map[string]IPStats      `json:"ips"`
+}
+
+// loadJob is a request scheduled to be sent at the time.
+type loadJob struct {
+	scheduled time.Time
+}
+
+func NewLoadGenerator(
+	cfg *LoadOptions,
+	curl *Curl,
+	m *metric.MetricsHandler,
+	e *event.EventHandler) (*LoadGenerator, error) {
+
+	if cfg.RPS == 0 {
+		return nil, fmt.Errorf("target requests per second must be greater than zero")
+	}
+	if curl.cfg.Count > 0 {
+		return nil, fmt.Errorf("requests count is not supported by the load generator, set the duration")
+	}
+	if cfg.Concurrency == 0 {
+		cfg.Concurrency = 1
+	}
+	if cfg.ReportIntervalSec == 0 {
+		cfg.ReportIntervalSec = 10
+	}
+	lg := LoadGenerator{
+		cfg:  cfg,
+		curl: curl,
+		m:    m,
+		e:    e,
+	}
+	return &lg, nil
+}
+
+// Start runs the load profile: ramp-up, steady and ramp-down. It
+// returns when the profile is finished, or never when the steady
+// duration is infinite.
+func (lg *LoadGenerator) Start() {
+	if lg.curl.cfg.SlowStartSec > 0 {
+		msg := fmt.Sprintf("Starting load generator in %ds", lg.curl.cfg.SlowStartSec)
+		lg.e.Send("request-client", "load-generator", msg)
+		time.Sleep(time.Duration(lg.curl.cfg.SlowStartSec) * time.Second)
+	}
+
+	jobs := make(chan loadJob, lg.cfg.Concurrency*100)
+	var wg sync.WaitGroup
+	for i := uint64(0); i < lg.cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				lg.send(job)
+			}
+		}()
+	}
+
+	now := time.Now()
+	lg.interval.start = now
+	lg.total.start = now
+	done := make(chan struct{})
+	go lg.runReporter(done)
+
+	lg.schedule(jobs)
+	close(jobs)
+	wg.Wait()
+	close(done)
+
+	lg.report("finished", &lg.total, 0)
+}
+
+// rate returns the phase and the target rate after the
+// elapsed time. The rate is zero when the profile is finished.
+func (lg *LoadGenerator) rate(elapsed time.Duration) (string, float64) {
+	target := float64(lg.cfg.RPS)
+	rampUp := time.Duration(lg.cfg.RampUpSec) * time.Second
+	steady := time.Duration(lg.cfg.DurationSec) * time.Second
+	rampDown := time.Duration(lg.cfg.RampDownSec) * time.Second
+
+	if elapsed < rampUp {
+		return "ramp-up", target * elapsed.Seconds() / rampUp.Seconds()
+	}
+	elapsed -= rampUp
+	if lg.cfg.DurationSec == 0 || elapsed < steady {
+		return "steady", target
+	}
+	elapsed -= steady
+	if elapsed < rampDown {
+		return "ramp-down", target * (1 - elapsed.Seconds()/rampDown.Seconds())
+	}
+	return "finished", 0
+}
+
+// schedule sends the jobs at the target rate. The next scheduled
+// time depends only on the previous one, when the workers are busy
+// the jobs are queued and the waiting is measured on latency.
+func (lg *LoadGenerator) schedule(jobs chan<- loadJob) {
+	// lowest rate on ramps, avoiding long gaps on the edges
+	minRate := math.Max(1, float64(lg.cfg.RPS)/100)
+	start := time.Now()
+	next := start
+	for {
+		phase, rate := lg.rate(next.Sub(start))
+		if phase == "finished" {
+			return
+		}
+		if rate < minRate {
+			rate = minRate
+		}
+		if wait := time.Until(next); wait > 0 {
+			time.Sleep(wait)
+		}
+		jobs <- loadJob{scheduled: next}
+		next = next.Add(time.Duration(float64(time.Second) / rate))
+	}
+}
+
+func (lg *LoadGenerator) send(job loadJob) {
+	start := time.Now()
+	resp, trace, err := lg.curl.request()
+	var failed *AssertionError
+	if err == nil {
+		failed = lg.curl.check(resp, start)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	end := time.Now()
+	lg.curl.record(resp, trace, err, failed, float64(end.Sub(start).Microseconds())/1000)
+	latency := float64(end.Sub(job.scheduled).Microseconds()) / 1000
+	serviceTime := float64(end.Sub(start).Microseconds()) / 1000
+
+	// samples of the whole run are kept only when it is finite
+	stats := []*loadStats{&lg.interval}
+	if lg.cfg.DurationSec > 0 {
+		stats = append(stats, &lg.total)
+	}
+
+	lg.locker.Lock()
+	for _, st := range stats {
+		st.requests += 1
+		if err != nil {
+			st.errors += 1
+		}
+		st.latencies = append(st.latencies, latency)
+		st.serviceTime = append(st.serviceTime, serviceTime)
+	}
+	lg.locker.Unlock()
+}
+
+// runReporter sends the report of each interval.
+func (lg *LoadGenerator) runReporter(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(lg.cfg.ReportIntervalSec) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			// swapped with the lock of the recording, the requests
+			// are counted on a single interval
+			lg.locker.Lock()
+			st := lg.interval
+			lg.interval = loadStats{start: time.Now()}
+			lg.locker.Unlock()
+			phase, rate := lg.rate(time.Since(lg.total.start))
+			lg.report(phase, &st, rate)
+		}
+	}
+}
+
+func (lg *LoadGenerator) report(phase string, st *loadStats, target float64) {
+	lg.locker.Lock()
+	rep := LoadReport{
+		Phase:         phase,
+		TargetRPS:     math.Round(target*100) / 100,
+		Requests:      st.requests,
+		Errors:        st.errors,
+		LatencyMs:     percentiles(st.latencies),
+		ServiceTimeMs: percentiles(st.serviceTime),
+		Backends:      lg.curl.backends.snapshot(),
+		IPs:           lg.curl.ips.snapshot(),
+	}
+	if elapsed := time.Since(st.start).Seconds(); elapsed > 0 {
+		rep.AchievedRPS = math.Round(float64(st.requests)/elapsed*100) / 100
+	}
+	lg.locker.Unlock()
+
+	data, _ := json.Marshal(&rep)
+	lg.e.Send("request-client", "load-generator", string(data))
+}
+
+// percentiles returns the p50, p90, p99 and max of the samples.
+func percentiles(samples []float64) map[string]float64 {
+	p := map[string]float64{"p50": 0, "p90": 0, "p99": 0, "max": 0}
+	if len(samples) == 0 {
+		return p
+	}
+	sorted := append([]float64{}, samples...)
+	sort.Float64s(sorted)
+	at := func(q float64) float64 {
+		return sorted[int(math.Ceil(q*float64(len(sorted))))-1]
+	}
+	p["p50"] = at(0.50)
+	p["p90"] = at(0.90)
+	p["p99"] = at(0.99)
+	p["max"] = sorted[len(sorted)-1]
+	return p
+}
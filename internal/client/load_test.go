@@ -0,0 +1,148 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mtulio/go-lab-api/internal/event"
+	"github.com/mtulio/go-lab-api/internal/metric"
+)
+
+// newTestCurl returns the client of the options, sending the events
+// to the returned log file.
+func newTestCurl(t *testing.T, cfg *CurlOptions) (*Curl, string) {
+	t.Helper()
+	logPath := filepath.Join(t.TempDir(), "events.log")
+	e := event.NewEventHandler("test", logPath)
+	t.Cleanup(e.Close)
+	c, err := NewCurlWithConfig(cfg, metric.NewMetricHandler(nil), e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, logPath
+}
+
+// readMessages returns the messages of the resource events on the log.
+func readMessages(t *testing.T, logPath, resource string) []string {
+	t.Helper()
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := []string{}
+	for _, text := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		line := struct {
+			Resource string `json:"resource"`
+			Msg      string `json:"msg"`
+		}{}
+		if err := json.Unmarshal([]byte(text), &line); err != nil {
+			t.Fatal(err)
+		}
+		if line.Resource == resource {
+			msgs = append(msgs, line.Msg)
+		}
+	}
+	return msgs
+}
+
+// runLoad runs the load profile against the handler, returning the
+// report of the whole run.
+func runLoad(t *testing.T, cfg *LoadOptions, handler http.HandlerFunc) LoadReport {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	c, logPath := newTestCurl(t, &CurlOptions{Endpoint: srv.URL, TimeoutSec: 5})
+	lg, err := NewLoadGenerator(cfg, c, c.m, c.e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lg.Start()
+
+	msgs := readMessages(t, logPath, "load-generator")
+	rep := LoadReport{}
+	if len(msgs) == 0 {
+		t.Fatal("load generator report not sent")
+	}
+	if err := json.Unmarshal([]byte(msgs[len(msgs)-1]), &rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep.Phase != "finished" {
+		t.Fatalf("got last report of phase %s", rep.Phase)
+	}
+	return rep
+}
+
+func TestLoadAchievedRate(t *testing.T) {
+	rep := runLoad(t, &LoadOptions{RPS: 50, Concurrency: 4, DurationSec: 1},
+		func(w http.ResponseWriter, r *http.Request) {})
+
+	// one request every 20ms during 1s
+	if rep.Requests != 50 || rep.Errors != 0 {
+		t.Errorf("got %d requests and %d errors, expected 50 requests", rep.Requests, rep.Errors)
+	}
+	if rep.AchievedRPS < 40 || rep.AchievedRPS > 51 {
+		t.Errorf("got %.2f requests per second, expected 50", rep.AchievedRPS)
+	}
+}
+
+func TestLoadCoordinatedOmission(t *testing.T) {
+	// a single worker serves 10 requests per second, half of the
+	// target rate: the requests wait more and more to be sent
+	rep := runLoad(t, &LoadOptions{RPS: 20, Concurrency: 1, DurationSec: 1},
+		func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(100 * time.Millisecond)
+		})
+
+	if rep.Requests != 20 {
+		t.Errorf("got %d requests, expected 20", rep.Requests)
+	}
+	if rep.AchievedRPS > 12 {
+		t.Errorf("got %.2f requests per second, expected 10", rep.AchievedRPS)
+	}
+	// the service time is the delay of the server, the last request
+	// is scheduled at 950ms and served at 2s
+	if rep.ServiceTimeMs["max"] < 100 || rep.ServiceTimeMs["max"] > 500 {
+		t.Errorf("got max service time %.1fms, expected 100ms", rep.ServiceTimeMs["max"])
+	}
+	if rep.LatencyMs["max"] < 1000 {
+		t.Errorf("got max latency %.1fms, expected from the scheduled time (1050ms)", rep.LatencyMs["max"])
+	}
+	if rep.LatencyMs["p50"] < 2*rep.ServiceTimeMs["p50"] {
+		t.Errorf("got latency p50 %.1fms, service time p50 %.1fms, expected the waiting time on latency",
+			rep.LatencyMs["p50"], rep.ServiceTimeMs["p50"])
+	}
+}
+
+func TestPercentiles(t *testing.T) {
+	samples := []float64{}
+	for i := 100; i > 0; i-- {
+		samples = append(samples, float64(i))
+	}
+	tests := []struct {
+		samples  []float64
+		expected map[string]float64
+	}{
+		{nil, map[string]float64{"p50": 0, "p90": 0, "p99": 0, "max": 0}},
+		{[]float64{7}, map[string]float64{"p50": 7, "p90": 7, "p99": 7, "max": 7}},
+		{[]float64{3, 1, 2, 4}, map[string]float64{"p50": 2, "p90": 4, "p99": 4, "max": 4}},
+		{samples, map[string]float64{"p50": 50, "p90": 90, "p99": 99, "max": 100}},
+	}
+	for _, tt := range tests {
+		got := percentiles(tt.samples)
+		for q, v := range tt.expected {
+			if got[q] != v {
+				t.Errorf("%d samples: got %s %.1f, expected %.1f", len(tt.samples), q, got[q], v)
+			}
+		}
+	}
+	// the samples are not sorted in place
+	if samples[0] != 100 {
+		t.Error("samples were sorted")
+	}
+}
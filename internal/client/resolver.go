@@ -0,0 +1,192 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mtulio/go-lab-api/internal/event"
+)
+
+// dialer controls how the client connects to the endpoints: the
+// IPs can be pinned or re-resolved on an interval, instead of using
+// the system resolver on each new connection. The IPs are used in
+// round robin, so each IP is exercised when new connections are
+// forced.
+type dialer struct {
+	// 64-bit atomic counters must be aligned
+	next uint64
+
+	cfg    *CurlOptions
+	e      *event.EventHandler
+	dialer *net.Dialer
+
+	locker   sync.Mutex
+	resolved map[string][]string
+
+	// resolver of the hosts on the interval, replaced by the tests
+	interval   time.Duration
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+}
+
+func newDialer(cfg *CurlOptions, e *event.EventHandler) *dialer {
+	d := dialer{
+		cfg: cfg,
+		e:   e,
+		dialer: &net.Dialer{
+			Timeout:   time.Duration(cfg.TimeoutSec) * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+		resolved: make(map[string][]string),
+
+		interval:   time.Duration(cfg.ResolveIntervalSec) * time.Second,
+		lookupHost: net.DefaultResolver.LookupHost,
+	}
+	if cfg.DisableKeepAlive {
+		d.dialer.KeepAlive = -1
+	}
+	return &d
+}
+
+// DialContext connects to one IP of the address host, the pinned
+// IPs or the last resolved ones. The system resolver is used when
+// there is no IP.
+func (d *dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips := d.cfg.PinIPs
+	if len(ips) == 0 {
+		d.locker.Lock()
+		ips = d.resolved[host]
+		d.locker.Unlock()
+	}
+	if len(ips) == 0 {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+	ip := ips[atomic.AddUint64(&d.next, 1)%uint64(len(ips))]
+	return d.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+}
+
+// StartResolver resolves the hosts on the interval, sending an
+// event when the IPs of the host change.
+func (d *dialer) StartResolver(hosts []string) {
+	for {
+		for _, host := range hosts {
+			d.resolve(host)
+		}
+		time.Sleep(d.interval)
+	}
+}
+
+func (d *dialer) resolve(host string) {
+	if net.ParseIP(host) != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.dialer.Timeout+time.Second)
+	defer cancel()
+	ips, err := d.lookupHost(ctx, host)
+	if err != nil {
+		msg := fmt.Sprintf("ERROR resolving %s, keeping the last IPs: %v", host, err)
+		d.e.Send("request-client", "resolver", msg)
+		return
+	}
+	sort.Strings(ips)
+
+	d.locker.Lock()
+	old := d.resolved[host]
+	d.resolved[host] = ips
+	d.locker.Unlock()
+
+	if strings.Join(old, ",") != strings.Join(ips, ",") {
+		msg := fmt.Sprintf("Host %s resolved from %v to %v", host, old, ips)
+		d.e.Send("request-client", "resolver", msg)
+	}
+}
+
+// IPStats are the outcomes of the requests sent to one IP.
+type IPStats struct {
+	Requests  uint64            `json:"requests"`
+	Errors    uint64            `json:"errors"`
+	Outcomes  map[string]uint64 `json:"outcomes"`
+	Failing   bool              `json:"failing"`
+	LastError string            `json:"last_error,omitempty"`
+	LastSeen  time.Time         `json:"last_seen"`
+}
+
+// IPEvent is sent when the IP starts failing or recovers.
+type IPEvent struct {
+	IP      string `json:"ip"`
+	Failing bool   `json:"failing"`
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ipTracker keeps the outcomes of the requests by remote IP.
+type ipTracker struct {
+	locker sync.Mutex
+	ips    map[string]*IPStats
+}
+
+func newIPTracker() *ipTracker {
+	return &ipTracker{
+		ips: make(map[string]*IPStats),
+	}
+}
+
+// observe registers the outcome of the request to the IP, returning
+// the event when the IP changed between failing and succeeding.
+func (it *ipTracker) observe(ip, outcome string, err error) *IPEvent {
+	if ip == "" {
+		return nil
+	}
+	failing := err != nil
+	it.locker.Lock()
+	defer it.locker.Unlock()
+
+	st, ok := it.ips[ip]
+	if !ok {
+		st = &IPStats{Outcomes: make(map[string]uint64)}
+		it.ips[ip] = st
+	}
+	st.Requests += 1
+	st.Outcomes[outcome] += 1
+	st.LastSeen = time.Now()
+	if failing {
+		st.Errors += 1
+		st.LastError = err.Error()
+	}
+	if st.Failing == failing {
+		return nil
+	}
+	st.Failing = failing
+
+	ev := IPEvent{IP: ip, Failing: failing, Outcome: outcome}
+	if failing {
+		ev.Error = err.Error()
+	}
+	return &ev
+}
+
+// snapshot returns a copy of the IP stats.
+func (it *ipTracker) snapshot() map[string]IPStats {
+	it.locker.Lock()
+	defer it.locker.Unlock()
+
+	snap := make(map[string]IPStats, len(it.ips))
+	for ip, st := range it.ips {
+		cp := *st
+		cp.Outcomes = make(map[string]uint64, len(st.Outcomes))
+		for outcome, count := range st.Outcomes {
+			cp.Outcomes[outcome] = count
+		}
+		snap[ip] = cp
+	}
+	return snap
+}
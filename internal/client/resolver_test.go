@@ -0,0 +1,147 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubResolver answers the lookups in order, the last answer is
+// repeated, recording the time of each lookup.
+type stubResolver struct {
+	locker  sync.Mutex
+	answers []stubAnswer
+	hosts   []string
+	calls   []time.Time
+}
+
+type stubAnswer struct {
+	ips []string
+	err error
+}
+
+func (r *stubResolver) lookupHost(ctx context.Context, host string) ([]string, error) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	answer := r.answers[len(r.answers)-1]
+	if len(r.calls) < len(r.answers) {
+		answer = r.answers[len(r.calls)]
+	}
+	r.hosts = append(r.hosts, host)
+	r.calls = append(r.calls, time.Now())
+	return answer.ips, answer.err
+}
+
+// waitCalls waits the resolver to be called n times, returning
+// the times of the calls and the hosts.
+func (r *stubResolver) waitCalls(t *testing.T, n int) ([]time.Time, []string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		r.locker.Lock()
+		calls, hosts := append([]time.Time{}, r.calls...), append([]string{}, r.hosts...)
+		r.locker.Unlock()
+		if len(calls) >= n {
+			return calls, hosts
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("resolver called %d times, expected %d", len(calls), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestResolverInterval(t *testing.T) {
+	c, logPath := newTestCurl(t, &CurlOptions{Endpoint: "http://lab.test", TimeoutSec: 1})
+	r := &stubResolver{answers: []stubAnswer{
+		{ips: []string{"127.0.0.2", "127.0.0.1"}},
+		// the same IPs in other order are not a change
+		{ips: []string{"127.0.0.1", "127.0.0.2"}},
+		{err: errors.New("server misbehaving")},
+		{ips: []string{"127.0.0.1"}},
+	}}
+	d := c.dialer
+	d.interval = 50 * time.Millisecond
+	d.lookupHost = r.lookupHost
+	go d.StartResolver([]string{"lab.test", "127.0.0.1"})
+
+	calls, hosts := r.waitCalls(t, 5)
+	for i := 1; i < len(calls); i++ {
+		if gap := calls[i].Sub(calls[i-1]); gap < d.interval || gap > 10*d.interval {
+			t.Errorf("lookup %d after %s, expected the interval of %s", i, gap, d.interval)
+		}
+	}
+	// the IPs are not resolved
+	for _, host := range hosts {
+		if host != "lab.test" {
+			t.Errorf("resolved host %s", host)
+		}
+	}
+	d.locker.Lock()
+	resolved := fmt.Sprint(d.resolved["lab.test"])
+	d.locker.Unlock()
+	if resolved != "[127.0.0.1]" {
+		t.Errorf("got IPs %s, expected [127.0.0.1]", resolved)
+	}
+
+	// the changes and the errors are reported
+	expected := []string{
+		"Host lab.test resolved from [] to [127.0.0.1 127.0.0.2]",
+		"ERROR resolving lab.test, keeping the last IPs: server misbehaving",
+		"Host lab.test resolved from [127.0.0.1 127.0.0.2] to [127.0.0.1]",
+	}
+	if got := readMessages(t, logPath, "resolver"); strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got resolver events %q, expected %q", got, expected)
+	}
+}
+
+// testServerPort returns the port of the test server.
+func testServerPort(t *testing.T, srv *httptest.Server) string {
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Port()
+}
+
+func TestResolverDial(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	port := testServerPort(t, srv)
+
+	// the host is connected on the resolved IPs
+	c, _ := newTestCurl(t, &CurlOptions{Endpoint: "http://lab.test:" + port, TimeoutSec: 1})
+	r := &stubResolver{answers: []stubAnswer{{ips: []string{"127.0.0.1"}}}}
+	c.dialer.lookupHost = r.lookupHost
+	c.dialer.resolve("lab.test")
+	resp, trace, err := c.request()
+	if err != nil {
+		t.Fatalf("request to the resolved IP: %v", err)
+	}
+	resp.Body.Close()
+	if trace.RemoteIP() != "127.0.0.1" {
+		t.Errorf("got remote IP %s, expected 127.0.0.1", trace.RemoteIP())
+	}
+
+	// the pinned IPs ignore the DNS
+	c, _ = newTestCurl(t, &CurlOptions{
+		Endpoint:   "http://lab-api.invalid:" + port,
+		TimeoutSec: 1,
+		PinIPs:     []string{"127.0.0.1"},
+	})
+	resp, trace, err = c.request()
+	if err != nil {
+		t.Fatalf("request to the pinned IP: %v", err)
+	}
+	resp.Body.Close()
+	if trace.RemoteIP() != "127.0.0.1" {
+		t.Errorf("got remote IP %s, expected 127.0.0.1", trace.RemoteIP())
+	}
+}
@@ -0,0 +1,209 @@
+package client
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mtulio/go-lab-api/internal/backoff"
+	"github.com/mtulio/go-lab-api/internal/event"
+	"github.com/mtulio/go-lab-api/internal/metric"
+)
+
+// tcpStableSession is the lifetime of a connection to restore the
+// reconnection backoff, the shorter sessions are reconnected with
+// backoff as the dial failures.
+const tcpStableSession = 10 * time.Second
+
+// TCPClient keeps persistent connections to the TCP/TLS server,
+// sending messages using the ServerTCP command protocol, to measure
+// the impact on established flows.
+type TCPClient struct {
+	cfg *TCPClientOptions
+	m   *metric.MetricsHandler
+	e   *event.EventHandler
+}
+
+type TCPClientOptions struct {
+	Address      string
+	TLS          bool
+	Connections  uint64
+	IntervalMs   uint64
+	TimeoutSec   uint8
+	SlowStartSec uint8
+	BackoffMinMs uint64
+	BackoffMaxMs uint64
+}
+
+// TCPConnEvent is the event sent when the client connection ends.
+type TCPConnEvent struct {
+	ConnID     uint64    `json:"conn_id"`
+	RemoteAddr string    `json:"remote_addr"`
+	LocalAddr  string    `json:"local_addr"`
+	OpenTime   time.Time `json:"open_time"`
+	CloseTime  time.Time `json:"close_time"`
+	LifetimeMs int64     `json:"lifetime_ms"`
+	Messages   uint64    `json:"messages"`
+	RTTAvgMs   float64   `json:"rtt_avg_ms"`
+	RTTMaxMs   float64   `json:"rtt_max_ms"`
+	Reason     string    `json:"reason"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func NewTCPClientWithConfig(
+	cfg *TCPClientOptions,
+	m *metric.MetricsHandler,
+	e *event.EventHandler) (*TCPClient, error) {
+
+	if cfg.Address == "" {
+		return nil, errors.New("TCP client address must be set")
+	}
+	if cfg.Connections == 0 {
+		cfg.Connections = 1
+	}
+
+	c := TCPClient{
+		cfg: cfg,
+		m:   m,
+		e:   e,
+	}
+	return &c, nil
+}
+
+// Start opens the persistent connections, each one is
+// reconnected with backoff when it is closed.
+func (c *TCPClient) Start() {
+	if c.cfg.SlowStartSec > 0 {
+		msg := fmt.Sprintf("Starting TCP client in %ds", c.cfg.SlowStartSec)
+		c.e.Send("request-client", "tcp-client", msg)
+		time.Sleep(time.Duration(c.cfg.SlowStartSec) * time.Second)
+	}
+
+	for id := uint64(0); id < c.cfg.Connections; id++ {
+		go c.runConnection(id)
+	}
+}
+
+// runConnection keeps the connection open, reconnecting
+// with exponential backoff and jitter on failures and on
+// sessions closed before tcpStableSession.
+func (c *TCPClient) runConnection(id uint64) {
+	bo := backoff.New(c.cfg.BackoffMinMs, c.cfg.BackoffMaxMs)
+	for {
+		conn, err := c.dial()
+		if err != nil {
+			c.m.Inc("tcp_cli_dial_errors")
+			delay := bo.Next()
+			msg := fmt.Sprintf("Connection %d: ERROR connecting to %s. Delaying %dms: %v", id, c.cfg.Address, delay.Milliseconds(), err)
+			c.e.Send("request-client", "tcp-client", msg)
+			time.Sleep(delay)
+			continue
+		}
+
+		c.m.Inc("tcp_cli_conn_opened")
+		ev := c.session(id, conn)
+		conn.Close()
+		c.m.Inc("tcp_cli_conn_closed")
+
+		data, _ := json.Marshal(ev)
+		c.e.Send("request-client", "tcp-client", string(data))
+
+		if time.Duration(ev.LifetimeMs)*time.Millisecond >= tcpStableSession {
+			bo.Reset()
+			continue
+		}
+		delay := bo.Next()
+		msg := fmt.Sprintf("Connection %d: closed after %dms (%s). Delaying %dms", id, ev.LifetimeMs, ev.Reason, delay.Milliseconds())
+		c.e.Send("request-client", "tcp-client", msg)
+		time.Sleep(delay)
+	}
+}
+
+func (c *TCPClient) dial() (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout: time.Duration(c.cfg.TimeoutSec) * time.Second,
+	}
+	if c.cfg.TLS {
+		tlsCfg := tls.Config{InsecureSkipVerify: true}
+		return tls.DialWithDialer(dialer, "tcp", c.cfg.Address, &tlsCfg)
+	}
+	return dialer.Dial("tcp", c.cfg.Address)
+}
+
+// session sends PING messages on the interval measuring the round
+// trip time, until the connection fails.
+func (c *TCPClient) session(id uint64, conn net.Conn) *TCPConnEvent {
+	ev := TCPConnEvent{
+		ConnID:     id,
+		RemoteAddr: conn.RemoteAddr().String(),
+		LocalAddr:  conn.LocalAddr().String(),
+		OpenTime:   time.Now(),
+	}
+	timeout := time.Duration(c.cfg.TimeoutSec) * time.Second
+	reader := bufio.NewReader(conn)
+	var rttSum float64 = 0
+
+	for {
+		start := time.Now()
+		if timeout > 0 {
+			conn.SetDeadline(start.Add(timeout))
+		}
+		_, err := conn.Write([]byte("PING\n"))
+		if err == nil {
+			var resp string
+			resp, err = reader.ReadString('\n')
+			if err == nil && strings.TrimSpace(resp) != "PONG" {
+				err = fmt.Errorf("unexpected response: %q", strings.TrimSpace(resp))
+			}
+		}
+		if err != nil {
+			ev.Reason = c.classifyError(err)
+			ev.Error = err.Error()
+			break
+		}
+
+		rtt := float64(time.Since(start).Microseconds()) / 1000
+		ev.Messages += 1
+		rttSum += rtt
+		if rtt > ev.RTTMaxMs {
+			ev.RTTMaxMs = rtt
+		}
+		c.m.Inc("tcp_cli_messages")
+		c.m.SetTCPClientRTT(rtt)
+
+		time.Sleep(time.Duration(c.cfg.IntervalMs) * time.Millisecond)
+	}
+
+	ev.CloseTime = time.Now()
+	ev.LifetimeMs = ev.CloseTime.Sub(ev.OpenTime).Milliseconds()
+	if ev.Messages > 0 {
+		ev.RTTAvgMs = rttSum / float64(ev.Messages)
+	}
+	return &ev
+}
+
+// classifyError returns the reason the connection has failed,
+// counting it on metrics.
+func (c *TCPClient) classifyError(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		c.m.Inc("tcp_cli_resets")
+		return "reset"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		c.m.Inc("tcp_cli_timeouts")
+		return "timeout"
+	case errors.Is(err, io.EOF):
+		c.m.Inc("tcp_cli_eof")
+		return "server-close"
+	}
+	c.m.Inc("tcp_cli_errors")
+	return "error"
+}
@@ -1,51 +1,163 @@
 package event
 
 import (
+	"fmt"
+	"log"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+// EventHandler formats the events as JSON lines, and fans them out
+// to the sinks accepting the event type.
 type EventHandler struct {
 	Type    string
 	AppName string
 	LogPath string
-	logr    *logrus.Logger
+
+	formatter logrus.Formatter
+	sinks     []*sink
+}
+
+// Event is the event sent to the sinks, Line is the JSON line with
+// the event fields.
+type Event struct {
+	Time     time.Time
+	Type     string
+	Resource string
+	Msg      string
+	Line     []byte
 }
 
+// NewEventHandler returns the handler writing to the log file, or to
+// stderr when it is empty or when the file can't be opened.
 func NewEventHandler(app, logPath string) *EventHandler {
-	ev := EventHandler{
-		AppName: app,
-		LogPath: logPath,
+	spec := "stderr"
+	if logPath != "" {
+		spec = fileSpec(logPath)
+	}
+	ev, err := NewEventHandlerWithSinks(app, []string{spec})
+	if err != nil {
+		log.Printf("Failed to log to file, using default stderr: %v", err)
+		ev, _ = NewEventHandlerWithSinks(app, []string{"stderr"})
 	}
-	var logr = logrus.New()
-	logr.SetFormatter(&logrus.JSONFormatter{})
+	ev.LogPath = logPath
+	return ev
+}
 
-	if logPath != "" {
-		file, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-		if err == nil {
-			logr.Out = file
-		} else {
-			logr.Info("Failed to log to file, using default stderr")
+// NewEventHandlerWithSinks returns the handler fanning out the events
+// to the sinks of the specs, stderr when it is empty.
+//
+// The specs are URLs with the sink options on the query. The types
+// option filters the event types of any sink, eg: types=runtime,request
+// (request matches request-client). Specs:
+//
+//	stderr, stdout
+//	file:///var/log/app.log?max-size=100&max-age=24h&max-backups=5
+//	syslog+udp://host:514?facility=local0, syslog+tcp://host:601, syslog+unix:///dev/log
+//	https://collector/events?batch=100&flush=1s&retries=3&queue=10000
+//
+// The file is rotated when it reaches max-size megabytes or it is
+// older than max-age, keeping max-backups rotated files (0 keeps all).
+// Syslog messages are RFC5424, octet counted on TCP. The webhook
+// posts the batches of events as a JSON array, retried with backoff.
+func NewEventHandlerWithSinks(app string, specs []string) (*EventHandler, error) {
+	ev := EventHandler{
+		AppName:   app,
+		formatter: &logrus.JSONFormatter{},
+	}
+	if len(specs) == 0 {
+		specs = []string{"stderr"}
+	}
+	for _, spec := range specs {
+		s, err := parseSink(spec, app)
+		if err != nil {
+			ev.Close()
+			return nil, fmt.Errorf("event sink %s: %w", spec, err)
 		}
+		ev.sinks = append(ev.sinks, s)
 	}
-
-	ev.logr = logr
-	return &ev
+	return &ev, nil
 }
 
 func (ev *EventHandler) SendEvent(tp, name, msg string) {
-	ev.logr.WithFields(logrus.Fields{
-		"app":      ev.AppName,
-		"type":     tp,
-		"resource": name,
-	}).Info(msg)
+	ev.Send(tp, name, msg)
 }
 
 func (ev *EventHandler) Send(tp, name, msg string) {
-	ev.logr.WithFields(logrus.Fields{
-		"app":      ev.AppName,
-		"type":     tp,
-		"resource": name,
-	}).Info(msg)
+	e := Event{
+		Time:     time.Now(),
+		Type:     tp,
+		Resource: name,
+		Msg:      msg,
+	}
+	line, err := ev.formatter.Format(&logrus.Entry{
+		Data: logrus.Fields{
+			"app":      ev.AppName,
+			"type":     tp,
+			"resource": name,
+		},
+		Time:    e.Time,
+		Level:   logrus.InfoLevel,
+		Message: msg,
+	})
+	if err != nil {
+		log.Printf("Failed to format the event: %v", err)
+		return
+	}
+	e.Line = line
+	for _, s := range ev.sinks {
+		if s.accepts(tp) {
+			s.write(&e)
+		}
+	}
+}
+
+// Close flushes and closes the sinks.
+func (ev *EventHandler) Close() {
+	for _, s := range ev.sinks {
+		if err := s.Close(); err != nil {
+			log.Printf("Failed to close the event sink %s: %v", s.name, err)
+		}
+	}
+}
+
+// sink is a Sink with the event types filter, reporting the write
+// errors on stderr when the sink starts and stops failing.
+type sink struct {
+	Sink
+	name    string
+	types   []string
+	locker  sync.Mutex
+	failing bool
+}
+
+// accepts returns whether the sink accepts the event type, the filter
+// matches the type and its subtypes: request matches request-client.
+func (s *sink) accepts(tp string) bool {
+	if len(s.types) == 0 {
+		return true
+	}
+	for _, t := range s.types {
+		if tp == t || (len(tp) > len(t) && tp[:len(t)] == t && tp[len(t)] == '-') {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *sink) write(e *Event) {
+	err := s.Write(e)
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	switch {
+	case err != nil && !s.failing:
+		s.failing = true
+		fmt.Fprintf(os.Stderr, "ERROR writing to the event sink %s, events are lost until it recovers: %v\n", s.name, err)
+	case err == nil && s.failing:
+		s.failing = false
+		fmt.Fprintf(os.Stderr, "Event sink %s recovered\n", s.name)
+	}
 }
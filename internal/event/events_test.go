@@ -0,0 +1,83 @@
+package event
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEvent returns the event of the type at the time.
+func testEvent(tp string, at time.Time, msg string) *Event {
+	return &Event{
+		Time: at,
+		Type: tp,
+		Msg:  msg,
+		Line: []byte(fmt.Sprintf("{\"msg\":%q}\n", msg)),
+	}
+}
+
+// readLines returns the lines of the file.
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestSinkAccepts(t *testing.T) {
+	s := sink{types: []string{"runtime", "request"}}
+	tests := []struct {
+		tp       string
+		expected bool
+	}{
+		{"runtime", true},
+		{"request", true},
+		{"request-client", true},
+		{"requests", false},
+		{"runtimex", false},
+		{"target", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := s.accepts(tt.tp); got != tt.expected {
+			t.Errorf("types %v accepts %q: %v, expected %v", s.types, tt.tp, got, tt.expected)
+		}
+	}
+
+	all := sink{}
+	if !all.accepts("target") {
+		t.Errorf("sink without types filter rejected the event")
+	}
+}
+
+func TestSendFiltersTypes(t *testing.T) {
+	dir := t.TempDir()
+	runtimeLog := filepath.Join(dir, "runtime.log")
+	allLog := filepath.Join(dir, "all.log")
+	ev, err := NewEventHandlerWithSinks("test", []string{
+		fileSpec(runtimeLog) + "?types=runtime",
+		fileSpec(allLog),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev.Send("runtime", "server", "started")
+	ev.Send("request-client", "curl", "request")
+	ev.Send("target", "tg-watcher", "healthy")
+	ev.Close()
+
+	if lines := readLines(t, runtimeLog); len(lines) != 1 || !strings.Contains(lines[0], `"msg":"started"`) {
+		t.Errorf("got runtime sink lines %q, expected the runtime event", lines)
+	}
+	if lines := readLines(t, allLog); len(lines) != 3 {
+		t.Errorf("got %d lines on the sink without filter, expected 3", len(lines))
+	}
+}
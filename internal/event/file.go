@@ -0,0 +1,126 @@
+package event
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotateTimeFormat is the suffix of the rotated files, sorted by time.
+const rotateTimeFormat = "20060102T150405.000"
+
+// fileOptions configures the file sink rotation, zero is disabled.
+type fileOptions struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+}
+
+// fileSink appends the JSON lines to the file, rotating it by size
+// and age.
+type fileSink struct {
+	options *fileOptions
+	file    *os.File
+	size    int64
+	opened  time.Time
+	locker  sync.Mutex
+}
+
+func newFileSink(op *fileOptions) (*fileSink, error) {
+	s := fileSink{options: op}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// open opens the file to append, the age of an existing file is
+// counted from its modification time.
+func (s *fileSink) open() error {
+	file, err := os.OpenFile(s.options.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	s.opened = time.Now()
+	if s.size > 0 {
+		s.opened = info.ModTime()
+	}
+	return nil
+}
+
+func (s *fileSink) Write(e *Event) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if s.file == nil {
+		// the last rotation failed to open the file
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.shouldRotate(int64(len(e.Line)), e.Time) {
+		if err := s.rotate(e.Time); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(e.Line)
+	s.size += int64(n)
+	return err
+}
+
+func (s *fileSink) shouldRotate(size int64, now time.Time) bool {
+	if s.size == 0 {
+		return false
+	}
+	op := s.options
+	return (op.maxSize > 0 && s.size+size > op.maxSize) ||
+		(op.maxAge > 0 && now.Sub(s.opened) >= op.maxAge)
+}
+
+// rotate renames the file with the time suffix, removing the oldest
+// rotated files, and opens a new one.
+func (s *fileSink) rotate(now time.Time) error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+	if err := os.Rename(s.options.path, s.options.path+"."+now.Format(rotateTimeFormat)); err != nil {
+		return err
+	}
+	if s.options.maxBackups > 0 {
+		matches, _ := filepath.Glob(s.options.path + ".*")
+		rotated := []string{}
+		for _, m := range matches {
+			if _, err := time.Parse(rotateTimeFormat, strings.TrimPrefix(m, s.options.path+".")); err == nil {
+				rotated = append(rotated, m)
+			}
+		}
+		sort.Strings(rotated)
+		for len(rotated) > s.options.maxBackups {
+			os.Remove(rotated[0])
+			rotated = rotated[1:]
+		}
+	}
+	return s.open()
+}
+
+func (s *fileSink) Close() error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
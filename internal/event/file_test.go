@@ -0,0 +1,71 @@
+package event
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileRotateSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	// files of other tools are not pruned
+	if err := os.WriteFile(path+".keep", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newFileSink(&fileOptions{path: path, maxSize: 100, maxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// lines of 16 bytes, 6 on each file
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := 0; i < 20; i++ {
+		if err := s.Write(testEvent("runtime", start.Add(time.Duration(i)*time.Second), "event")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// rotated on the 7th, 13th and 19th events, keeping the newest two
+	rotated, _ := filepath.Glob(path + ".2*")
+	expected := []string{
+		path + "." + start.Add(12*time.Second).Format(rotateTimeFormat),
+		path + "." + start.Add(18*time.Second).Format(rotateTimeFormat),
+	}
+	if len(rotated) != len(expected) || rotated[0] != expected[0] || rotated[1] != expected[1] {
+		t.Errorf("got rotated files %v, expected %v", rotated, expected)
+	}
+	if lines := readLines(t, path); len(lines) != 2 {
+		t.Errorf("got %d lines on the current file, expected 2", len(lines))
+	}
+	if _, err := os.Stat(path + ".keep"); err != nil {
+		t.Errorf("file of another tool was removed: %v", err)
+	}
+}
+
+func TestFileRotateAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	s, err := newFileSink(&fileOptions{path: path, maxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	now := time.Now()
+	for _, at := range []time.Time{now, now.Add(30 * time.Minute), now.Add(2 * time.Hour)} {
+		if err := s.Write(testEvent("runtime", at, "event")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) != 1 {
+		t.Fatalf("got rotated files %v, expected one", rotated)
+	}
+	if lines := readLines(t, rotated[0]); len(lines) != 2 {
+		t.Errorf("got %d lines on the rotated file, expected 2", len(lines))
+	}
+	if lines := readLines(t, path); len(lines) != 1 {
+		t.Errorf("got %d lines on the current file, expected 1", len(lines))
+	}
+}
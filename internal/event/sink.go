@@ -0,0 +1,171 @@
+package event
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sink writes the events, eg: a file or a remote collector.
+type Sink interface {
+	Write(e *Event) error
+	Close() error
+}
+
+// parseSink returns the sink of the spec, see NewEventHandlerWithSinks.
+func parseSink(spec, app string) (*sink, error) {
+	s := sink{name: spec}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	if types := query.Get("types"); types != "" {
+		s.types = strings.Split(types, ",")
+	}
+	query.Del("types")
+	opts := sinkOptions{query: query}
+
+	if u.Scheme == "" {
+		u.Scheme = u.Path
+	}
+	switch u.Scheme {
+	case "stderr":
+		s.name = "stderr"
+		s.Sink = &writerSink{out: os.Stderr}
+	case "stdout":
+		s.name = "stdout"
+		s.Sink = &writerSink{out: os.Stdout}
+	case "file":
+		// file://logs/app.log and file:logs/app.log are relative,
+		// file:///var/log/app.log absolute
+		path := u.Host + u.Path
+		if u.Opaque != "" {
+			path, err = url.PathUnescape(u.Opaque)
+			if err != nil {
+				return nil, err
+			}
+		}
+		s.name = "file://" + path
+		op := fileOptions{
+			path:       path,
+			maxSize:    opts.int64("max-size", 0) * 1024 * 1024,
+			maxAge:     opts.duration("max-age", 0),
+			maxBackups: int(opts.int64("max-backups", 0)),
+		}
+		if opts.err != nil {
+			return nil, opts.err
+		}
+		s.Sink, err = newFileSink(&op)
+	case "syslog+udp", "syslog+tcp", "syslog+unix":
+		addr := u.Host
+		if u.Scheme == "syslog+unix" {
+			addr = u.Path
+		}
+		s.name = u.Scheme + "://" + addr
+		s.Sink, err = newSyslogSink(strings.TrimPrefix(u.Scheme, "syslog+"), addr, app, opts.get("facility", "local0"))
+	case "http", "https":
+		op := webhookOptions{
+			batch:   int(opts.int64("batch", 100)),
+			flush:   opts.duration("flush", time.Second),
+			retries: int(opts.int64("retries", 3)),
+			queue:   int(opts.int64("queue", 10000)),
+		}
+		if opts.err != nil {
+			return nil, opts.err
+		}
+		// the sink options are not sent to the collector
+		u.RawQuery = query.Encode()
+		op.url = u.String()
+		s.name = u.Scheme + "://" + u.Host + u.Path
+		s.Sink = newWebhookSink(&op)
+	default:
+		return nil, fmt.Errorf("unknown sink %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// SinkSpecs returns the specs of the sinks flags, the log path is
+// appended as a file sink.
+func SinkSpecs(sinks []string, logPath string) []string {
+	specs := append([]string{}, sinks...)
+	if logPath != "" {
+		specs = append(specs, fileSpec(logPath))
+	}
+	return specs
+}
+
+// fileSpec returns the spec of the file sink, escaping the path. The
+// relative paths are opaque, the first directory is not a host.
+func fileSpec(path string) string {
+	u := url.URL{Scheme: "file", Path: path}
+	if !strings.HasPrefix(path, "/") {
+		u = url.URL{Scheme: "file", Opaque: u.EscapedPath()}
+	}
+	return u.String()
+}
+
+// sinkOptions reads the options of the sink from the query, the
+// options read are removed, the first invalid one sets err.
+type sinkOptions struct {
+	query url.Values
+	err   error
+}
+
+func (o *sinkOptions) get(name, def string) string {
+	v := o.query.Get(name)
+	o.query.Del(name)
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+func (o *sinkOptions) int64(name string, def int64) int64 {
+	v := o.get(name, "")
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil && o.err == nil {
+		o.err = fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return n
+}
+
+func (o *sinkOptions) duration(name string, def time.Duration) time.Duration {
+	v := o.get(name, "")
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil && o.err == nil {
+		o.err = fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return d
+}
+
+// writerSink writes the JSON lines to stderr or stdout.
+type writerSink struct {
+	out    io.Writer
+	locker sync.Mutex
+}
+
+func (w *writerSink) Write(e *Event) error {
+	w.locker.Lock()
+	defer w.locker.Unlock()
+	_, err := w.out.Write(e.Line)
+	return err
+}
+
+func (w *writerSink) Close() error {
+	return nil
+}
@@ -0,0 +1,128 @@
+package event
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSinkWriters(t *testing.T) {
+	tests := []struct {
+		spec  string
+		out   *os.File
+		types []string
+	}{
+		{"stderr", os.Stderr, nil},
+		{"stdout", os.Stdout, nil},
+		{"stderr?types=runtime,request", os.Stderr, []string{"runtime", "request"}},
+	}
+	for _, tt := range tests {
+		s, err := parseSink(tt.spec, "test")
+		if err != nil {
+			t.Errorf("%s: %v", tt.spec, err)
+			continue
+		}
+		w, ok := s.Sink.(*writerSink)
+		if !ok || w.out != tt.out {
+			t.Errorf("%s: got sink %T %s", tt.spec, s.Sink, s.name)
+		}
+		if strings.Join(s.types, ",") != strings.Join(tt.types, ",") {
+			t.Errorf("%s: got types %v, expected %v", tt.spec, s.types, tt.types)
+		}
+	}
+}
+
+func TestParseSinkFile(t *testing.T) {
+	dir := t.TempDir()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Mkdir("logs", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		spec string
+		path string
+	}{
+		// relative paths
+		{"file://logs/app.log", "logs/app.log"},
+		{"file:logs/app%20b.log", "logs/app b.log"},
+		// absolute path, with the characters escaped by SinkSpecs
+		{"file://" + dir + "/app.log", dir + "/app.log"},
+		{SinkSpecs(nil, dir+"/a?b#c%d.log")[0], dir + "/a?b#c%d.log"},
+		{SinkSpecs(nil, "logs/a?b.log")[0], "logs/a?b.log"},
+	}
+	for _, tt := range tests {
+		s, err := parseSink(tt.spec, "test")
+		if err != nil {
+			t.Errorf("%s: %v", tt.spec, err)
+			continue
+		}
+		if got := s.Sink.(*fileSink).options.path; got != tt.path {
+			t.Errorf("%s: got path %q, expected %q", tt.spec, got, tt.path)
+		}
+		if _, err := os.Stat(tt.path); err != nil {
+			t.Errorf("%s: file not created: %v", tt.spec, err)
+		}
+		s.Close()
+	}
+
+	s, err := parseSink("file://"+filepath.Join(dir, "rotated.log")+"?max-size=2&max-age=1h&max-backups=3&types=runtime", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	op := s.Sink.(*fileSink).options
+	if op.maxSize != 2*1024*1024 || op.maxAge != time.Hour || op.maxBackups != 3 {
+		t.Errorf("got options %+v", op)
+	}
+}
+
+func TestParseSinkWebhook(t *testing.T) {
+	s, err := parseSink("https://collector/events?batch=10&flush=2s&retries=1&queue=50&token=abc&types=runtime", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	op := s.Sink.(*webhookSink).options
+	// the sink options are not sent to the collector
+	if op.url != "https://collector/events?token=abc" {
+		t.Errorf("got url %s", op.url)
+	}
+	if op.batch != 10 || op.flush != 2*time.Second || op.retries != 1 || op.queue != 50 {
+		t.Errorf("got options %+v", op)
+	}
+	if s.name != "https://collector/events" {
+		t.Errorf("got name %s, the query must be hidden", s.name)
+	}
+}
+
+func TestParseSinkErrors(t *testing.T) {
+	dir := t.TempDir()
+	for _, spec := range []string{
+		"kafka://broker:9092",
+		"file://" + dir + "/app.log?max-size=big",
+		"file://" + dir + "/app.log?max-age=1day",
+		"https://collector/events?batch=ten",
+		"https://collector/events?flush=soon",
+		"syslog+udp://127.0.0.1:514?facility=local9",
+		"file://" + dir + "/missing/app.log",
+	} {
+		if s, err := parseSink(spec, "test"); err == nil {
+			s.Close()
+			t.Errorf("%s: invalid spec was accepted", spec)
+		}
+	}
+
+	if _, err := NewEventHandlerWithSinks("test", []string{"stderr", "kafka://broker:9092"}); err == nil {
+		t.Errorf("handler with an invalid spec was created")
+	}
+}
@@ -0,0 +1,165 @@
+package event
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mtulio/go-lab-api/internal/backoff"
+)
+
+// syslogTimeout is the timeout to connect and to write a message.
+const syslogTimeout = 5 * time.Second
+
+// syslogSeverityInfo is the severity of the events.
+const syslogSeverityInfo = 6
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogSink sends the events as RFC5424 messages, the message ID is
+// the event type and the message is the JSON line. The connection is
+// dialed again with backoff after a write or a dial error: the events
+// are dropped meanwhile, not waiting the dial.
+type syslogSink struct {
+	network  string
+	addr     string
+	priority int
+	hostname string
+	app      string
+
+	// connection and its network: udp, tcp, unixgram or unix
+	conn    net.Conn
+	connNet string
+	locker  sync.Mutex
+
+	// backoff of the failed dials and writes, no dial before retryAt
+	bo      *backoff.Backoff
+	retryAt time.Time
+}
+
+func newSyslogSink(network, addr, app, facility string) (*syslogSink, error) {
+	code, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	s := syslogSink{
+		network:  network,
+		addr:     addr,
+		priority: code*8 + syslogSeverityInfo,
+		hostname: hostname,
+		app:      syslogField(app, 48),
+		bo:       backoff.New(1000, 60000),
+	}
+	if err := s.dial(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// dial connects to the syslog server, the unix sockets are tried as
+// datagram then stream sockets.
+func (s *syslogSink) dial() error {
+	network := s.network
+	if network == "unix" {
+		conn, err := net.DialTimeout("unixgram", s.addr, syslogTimeout)
+		if err == nil {
+			s.conn, s.connNet = conn, "unixgram"
+			return nil
+		}
+	}
+	conn, err := net.DialTimeout(network, s.addr, syslogTimeout)
+	if err != nil {
+		return err
+	}
+	s.conn, s.connNet = conn, network
+	return nil
+}
+
+// syslogField returns the header field: printable ASCII up to the
+// maximum length, "-" when it is empty.
+func syslogField(v string, max int) string {
+	v = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, v)
+	if len(v) > max {
+		v = v[:max]
+	}
+	if v == "" {
+		return "-"
+	}
+	return v
+}
+
+// message returns the RFC5424 message of the event, without the
+// structured data.
+func (s *syslogSink) message(e *Event) []byte {
+	return []byte(fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+		s.priority,
+		e.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		s.hostname,
+		s.app,
+		os.Getpid(),
+		syslogField(e.Type, 32),
+		bytes.TrimRight(e.Line, "\n"),
+	))
+}
+
+func (s *syslogSink) Write(e *Event) error {
+	msg := s.message(e)
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if s.conn == nil {
+		if wait := time.Until(s.retryAt); wait > 0 {
+			return fmt.Errorf("syslog server unavailable, dialing again in %dms", wait.Milliseconds())
+		}
+		if err := s.dial(); err != nil {
+			s.retryAt = time.Now().Add(s.bo.Next())
+			return err
+		}
+	}
+
+	// TCP is octet counted (RFC6587), the stream unix socket
+	// is newline terminated.
+	switch s.connNet {
+	case "tcp":
+		msg = append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+	case "unix":
+		msg = append(msg, '\n')
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+	if _, err := s.conn.Write(msg); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		s.retryAt = time.Now().Add(s.bo.Next())
+		return err
+	}
+	s.bo.Reset()
+	return nil
+}
+
+func (s *syslogSink) Close() error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
@@ -0,0 +1,150 @@
+package event
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// expectedSyslog returns the RFC5424 message of the test event sent
+// by the app "my app" on local0.
+func expectedSyslog(t *testing.T, at time.Time) string {
+	t.Helper()
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	return fmt.Sprintf(`<134>1 %s %s my_app %d runtime - {"msg":"started"}`,
+		at.Format("2006-01-02T15:04:05.000000Z07:00"), hostname, os.Getpid())
+}
+
+func TestSyslogTCPOctetCounting(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	s, err := newSyslogSink("tcp", ln.Addr().String(), "my app", "local0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	at := time.Date(2024, 1, 2, 3, 4, 5, 123456000, time.UTC)
+	for i := 0; i < 2; i++ {
+		if err := s.Write(testEvent("runtime", at, "started")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// each message is prefixed by its length and a space
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		count, err := reader.ReadString(' ')
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(count, " "))
+		if err != nil {
+			t.Fatalf("invalid octet count %q: %v", count, err)
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(reader, msg); err != nil {
+			t.Fatal(err)
+		}
+		if expected := expectedSyslog(t, at); string(msg) != expected {
+			t.Errorf("got message %q, expected %q", msg, expected)
+		}
+	}
+}
+
+func TestSyslogUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	s, err := newSyslogSink("udp", pc.LocalAddr().String(), "my app", "local0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	at := time.Now()
+	if err := s.Write(testEvent("runtime", at, "started")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := expectedSyslog(t, at); string(buf[:n]) != expected {
+		t.Errorf("got message %q, expected %q", buf[:n], expected)
+	}
+}
+
+func TestSyslogDialBackoff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.sock")
+	pc, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSyslogSink("unix", path, "my app", "local0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.connNet != "unixgram" {
+		t.Errorf("got network %s, expected unixgram", s.connNet)
+	}
+
+	// the server is down: the write fails, the next one doesn't dial
+	pc.Close()
+	os.Remove(path)
+	if err := s.Write(testEvent("runtime", time.Now(), "lost")); err == nil {
+		t.Fatal("write to the closed socket succeeded")
+	}
+	if s.conn != nil || !s.retryAt.After(time.Now()) {
+		t.Fatalf("connection not closed with backoff, retry at %s", s.retryAt)
+	}
+	pc, err = net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if err := s.Write(testEvent("runtime", time.Now(), "dropped")); err == nil || s.conn != nil {
+		t.Fatalf("dialed during the backoff, error %v", err)
+	}
+
+	// dialed again after the backoff
+	s.retryAt = time.Time{}
+	if err := s.Write(testEvent("runtime", time.Now(), "sent")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(buf[:n]), `{"msg":"sent"}`) {
+		t.Errorf("got message %q", buf[:n])
+	}
+}
@@ -0,0 +1,192 @@
+package event
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mtulio/go-lab-api/internal/backoff"
+)
+
+var errWebhookQueueFull = errors.New("webhook queue is full, dropping events")
+
+// webhookCloseTimeout is the time to send the queued events on Close,
+// the events left are dropped. It is a variable for the tests.
+var webhookCloseTimeout = 5 * time.Second
+
+// webhookOptions configures the batches of the webhook sink.
+type webhookOptions struct {
+	url string
+	// events of each batch, and the interval to send a partial one
+	batch int
+	flush time.Duration
+	// retries of a failed batch, and the events waiting to be sent
+	retries int
+	queue   int
+}
+
+// webhookSink posts the events in batches as a JSON array, on the
+// background. The failed batches are retried with backoff, then
+// dropped: the error is returned by the next writes until a batch is
+// delivered.
+type webhookSink struct {
+	options *webhookOptions
+	client  *http.Client
+	queue   chan json.RawMessage
+	done    chan struct{}
+
+	// canceled when the close timeout is reached, aborting the
+	// requests and the retries
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	locker  sync.Mutex
+	closed  bool
+	lastErr error
+}
+
+func newWebhookSink(op *webhookOptions) *webhookSink {
+	if op.batch <= 0 {
+		op.batch = 1
+	}
+	if op.flush <= 0 {
+		op.flush = time.Second
+	}
+	if op.queue < op.batch {
+		op.queue = op.batch
+	}
+	s := webhookSink{
+		options: op,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queue:   make(chan json.RawMessage, op.queue),
+		done:    make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	go s.run()
+	return &s
+}
+
+func (s *webhookSink) Write(e *Event) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if s.closed {
+		return errors.New("webhook sink is closed")
+	}
+	select {
+	case s.queue <- json.RawMessage(bytes.TrimRight(e.Line, "\n")):
+	default:
+		return errWebhookQueueFull
+	}
+	return s.lastErr
+}
+
+// run sends the batch when it is full or on the flush interval, until
+// the queue is closed.
+func (s *webhookSink) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.options.flush)
+	defer ticker.Stop()
+	batch := make([]json.RawMessage, 0, s.options.batch)
+	for {
+		select {
+		case line, ok := <-s.queue:
+			if !ok {
+				if len(batch) > 0 {
+					s.post(batch)
+				}
+				return
+			}
+			batch = append(batch, line)
+			if len(batch) < s.options.batch {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		s.post(batch)
+		batch = batch[:0]
+	}
+}
+
+// post posts the batch, retrying the connection errors, the throttling
+// and the server errors with backoff.
+func (s *webhookSink) post(batch []json.RawMessage) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		s.setError(err)
+		return
+	}
+	bo := backoff.New(500, 30000)
+	for attempt := 0; ; attempt++ {
+		if s.ctx.Err() != nil {
+			s.setError(fmt.Errorf("batch of %d events dropped on close", len(batch)))
+			return
+		}
+		retry := false
+		req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, s.options.url, bytes.NewReader(body))
+		if err != nil {
+			s.setError(err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := s.client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			switch {
+			case resp.StatusCode < 300:
+				s.setError(nil)
+				return
+			case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+				retry = true
+			}
+			err = fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		} else {
+			retry = true
+		}
+		if !retry || attempt >= s.options.retries {
+			s.setError(fmt.Errorf("batch of %d events dropped after %d attempts: %w", len(batch), attempt+1, err))
+			return
+		}
+		select {
+		case <-time.After(bo.Next()):
+		case <-s.ctx.Done():
+		}
+	}
+}
+
+func (s *webhookSink) setError(err error) {
+	s.locker.Lock()
+	s.lastErr = err
+	s.locker.Unlock()
+}
+
+// Close sends the events on the queue, waiting the last batch up to
+// webhookCloseTimeout. The events not sent by then are dropped.
+func (s *webhookSink) Close() error {
+	s.locker.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.locker.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookCloseTimeout)
+	defer cancel()
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		s.cancel()
+		return fmt.Errorf("webhook sink closed after %s, dropping the queued events", webhookCloseTimeout)
+	}
+	s.cancel()
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	return s.lastErr
+}
@@ -0,0 +1,165 @@
+package event
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collector is the webhook server recording the batches received, it
+// answers the statuses in order then 200.
+type collector struct {
+	locker   sync.Mutex
+	statuses []int
+	attempts int
+	batches  [][]map[string]string
+	received chan struct{}
+}
+
+func newCollector(t *testing.T, statuses ...int) (*collector, *httptest.Server) {
+	c := &collector{statuses: statuses, received: make(chan struct{}, 100)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.locker.Lock()
+		defer c.locker.Unlock()
+		c.attempts++
+		if len(c.statuses) > 0 {
+			status := c.statuses[0]
+			c.statuses = c.statuses[1:]
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+		}
+		batch := []map[string]string{}
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Errorf("invalid batch: %v", err)
+		}
+		c.batches = append(c.batches, batch)
+		c.received <- struct{}{}
+	}))
+	t.Cleanup(srv.Close)
+	return c, srv
+}
+
+// result returns the attempts and the batches received, the handler
+// can still be returning after the response.
+func (c *collector) result() (int, [][]map[string]string) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	return c.attempts, append([][]map[string]string{}, c.batches...)
+}
+
+func batchSizes(batches [][]map[string]string) []int {
+	sizes := []int{}
+	for _, b := range batches {
+		sizes = append(sizes, len(b))
+	}
+	return sizes
+}
+
+func TestWebhookBatch(t *testing.T) {
+	c, srv := newCollector(t)
+	s := newWebhookSink(&webhookOptions{url: srv.URL, batch: 3, flush: time.Hour, queue: 10})
+	for i := 0; i < 7; i++ {
+		if err := s.Write(testEvent("runtime", time.Now(), fmt.Sprintf("event %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the last partial batch is sent on close
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, batches := c.result()
+	if sizes := batchSizes(batches); fmt.Sprint(sizes) != "[3 3 1]" {
+		t.Fatalf("got batches of %v events, expected [3 3 1]", sizes)
+	}
+	if msg := batches[2][0]["msg"]; msg != "event 6" {
+		t.Errorf("got last event %q, expected %q", msg, "event 6")
+	}
+	if err := s.Write(testEvent("runtime", time.Now(), "closed")); err == nil {
+		t.Error("write after close succeeded")
+	}
+}
+
+func TestWebhookFlush(t *testing.T) {
+	c, srv := newCollector(t)
+	s := newWebhookSink(&webhookOptions{url: srv.URL, batch: 100, flush: 50 * time.Millisecond})
+	defer s.Close()
+	for i := 0; i < 2; i++ {
+		if err := s.Write(testEvent("runtime", time.Now(), "event")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-c.received:
+	case <-time.After(2 * time.Second):
+		t.Fatal("partial batch not flushed on the interval")
+	}
+	_, batches := c.result()
+	if sizes := batchSizes(batches); fmt.Sprint(sizes) != "[2]" {
+		t.Errorf("got batches of %v events, expected [2]", sizes)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		retries  int
+		attempts int
+		batches  int
+		fail     bool
+	}{
+		{"server error and throttling", []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}, 2, 3, 1, false},
+		{"retries exhausted", []int{500, 500, 500}, 1, 2, 0, true},
+		{"client error", []int{http.StatusBadRequest}, 2, 1, 0, true},
+	}
+	for _, tt := range tests {
+		c, srv := newCollector(t, tt.statuses...)
+		s := newWebhookSink(&webhookOptions{url: srv.URL, batch: 1, retries: tt.retries})
+		if err := s.Write(testEvent("runtime", time.Now(), "event")); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		err := s.Close()
+		if tt.fail != (err != nil) {
+			t.Errorf("%s: got error %v", tt.name, err)
+		}
+		attempts, batches := c.result()
+		if attempts != tt.attempts || len(batches) != tt.batches {
+			t.Errorf("%s: got %d attempts and %d batches, expected %d and %d", tt.name, attempts, len(batches), tt.attempts, tt.batches)
+		}
+	}
+}
+
+func TestWebhookCloseTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { webhookCloseTimeout = timeout }(webhookCloseTimeout)
+	webhookCloseTimeout = 100 * time.Millisecond
+
+	// the collector hangs until the end of the test
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+	s := newWebhookSink(&webhookOptions{url: srv.URL, batch: 1, retries: 3})
+	if err := s.Write(testEvent("runtime", time.Now(), "event")); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := s.Close(); err == nil {
+		t.Error("close of the blocked webhook returned no error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("close took %s", elapsed)
+	}
+	select {
+	case <-s.done:
+	case <-time.After(2 * time.Second):
+		t.Error("sink still sending after close")
+	}
+}
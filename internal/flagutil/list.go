@@ -0,0 +1,16 @@
+// Package flagutil has the helpers to read the command line flags
+// shared by the commands.
+package flagutil
+
+import "strings"
+
+// SplitList returns the items of the comma-separated list.
+func SplitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,7 @@
+// Package header has the HTTP headers shared by the servers
+// and the clients.
+package header
+
+// InstanceID is the response header identifying the instance
+// which served the request, when traffic is balanced.
+const InstanceID = "X-Instance-Id"
@@ -3,6 +3,7 @@ package metric
 import (
 	"encoding/json"
 	"log"
+	"sort"
 	"sync"
 	"time"
 
@@ -20,6 +21,17 @@ type MetricsHandler struct {
 	TargetHealthCount   uint64 `json:"tg_health_count"`
 	TargetUnhealthCount uint64 `json:"tg_unhealth_count"`
 
+	// Targets by state, and the state of this instance target
+	TargetStates    map[string]uint64 `json:"tg_states"`
+	SelfTargetState string            `json:"self_target_state"`
+
+	// Metrics of each target group, the global ones are aggregated
+	TargetGroups map[string]*TargetGroupMetrics `json:"tg_groups"`
+
+	// Individual checks of the application readiness
+	AppChecks           map[string]bool   `json:"app_checks"`
+	AppCheckTransitions map[string]uint64 `json:"app_check_transitions"`
+
 	// Request counters
 	mxReqService      sync.Mutex
 	ReqCountService   uint64 `json:"reqc_service"`
@@ -27,13 +39,78 @@ type MetricsHandler struct {
 	ReqCountHC        uint64 `json:"reqc_hc"`
 	mxReqCli          sync.Mutex
 	ReqCountClient    uint64 `json:"reqc_client"`
+	ReqCountClient1xx uint64 `json:"reqc_client_1xx"`
 	ReqCountClient2xx uint64 `json:"reqc_client_2xx"`
+	ReqCountClient3xx uint64 `json:"reqc_client_3xx"`
 	ReqCountClient4xx uint64 `json:"reqc_client_4xx"`
 	ReqCountClient5xx uint64 `json:"reqc_client_5xx"`
 
+	// Client responses by backend instance
+	ClientBackends map[string]uint64 `json:"reqc_client_backends"`
+
+	// Client error and failed assertion counters, by class
+	mxCliErr             sync.Mutex
+	CliErrors            uint64 `json:"reqc_client_errors"`
+	CliErrDNS            uint64 `json:"reqc_client_err_dns"`
+	CliErrConnectRefused uint64 `json:"reqc_client_err_connect_refused"`
+	CliErrConnectTimeout uint64 `json:"reqc_client_err_connect_timeout"`
+	CliErrTLSHandshake   uint64 `json:"reqc_client_err_tls_handshake"`
+	CliErrConnReset      uint64 `json:"reqc_client_err_conn_reset"`
+	CliErrReadTimeout    uint64 `json:"reqc_client_err_read_timeout"`
+	CliErrOther          uint64 `json:"reqc_client_err_other"`
+	CliAssertFailed      uint64 `json:"reqc_client_assert_failed"`
+	CliAssertStatus      uint64 `json:"reqc_client_assert_status"`
+	CliAssertBody        uint64 `json:"reqc_client_assert_body"`
+	CliAssertHeader      uint64 `json:"reqc_client_assert_header"`
+	CliAssertJSON        uint64 `json:"reqc_client_assert_json"`
+	CliAssertLatency     uint64 `json:"reqc_client_assert_latency"`
+
+	// Target group watcher API calls, retries and errors by class
+	mxTGErr       sync.Mutex
+	TGAPICalls    uint64 `json:"tg_api_calls"`
+	TGAPIRetries  uint64 `json:"tg_api_retries"`
+	TGErrors      uint64 `json:"tg_errors"`
+	TGErrThrottle uint64 `json:"tg_err_throttle"`
+	TGErrNotFound uint64 `json:"tg_err_not_found"`
+	TGErrAuth     uint64 `json:"tg_err_auth"`
+	TGErrOther    uint64 `json:"tg_err_other"`
+
+	// TCP client counters
+	mxTCPCli            sync.Mutex
+	ReqCountTCPClient   uint64  `json:"reqc_tcp_client"`
+	TCPClientConnOpened uint64  `json:"tcp_cli_conn_opened"`
+	TCPClientConnClosed uint64  `json:"tcp_cli_conn_closed"`
+	TCPClientDialErrors uint64  `json:"tcp_cli_dial_errors"`
+	TCPClientResets     uint64  `json:"tcp_cli_resets"`
+	TCPClientTimeouts   uint64  `json:"tcp_cli_timeouts"`
+	TCPClientEOF        uint64  `json:"tcp_cli_eof"`
+	TCPClientErrors     uint64  `json:"tcp_cli_errors"`
+	TCPClientRTTMs      float64 `json:"tcp_cli_rtt_ms"`
+
+	// Connection counters
+	mxConn                sync.Mutex
+	ConnOpen              uint64 `json:"conn_open"`
+	ConnTotal             uint64 `json:"conn_total"`
+	ConnClosedClientFin   uint64 `json:"conn_closed_client_fin"`
+	ConnClosedClientRst   uint64 `json:"conn_closed_client_rst"`
+	ConnClosedServerClose uint64 `json:"conn_closed_server_close"`
+	ConnClosedIdleTimeout uint64 `json:"conn_closed_idle_timeout"`
+	ConnBytesIn           uint64 `json:"conn_bytes_in"`
+	ConnBytesOut          uint64 `json:"conn_bytes_out"`
+
 	event *event.EventHandler
 }
 
+// TargetGroupMetrics are the metrics of one target group.
+type TargetGroupMetrics struct {
+	Healthy       bool              `json:"healthy"`
+	HealthCount   uint64            `json:"health_count"`
+	UnhealthCount uint64            `json:"unhealth_count"`
+	States        map[string]uint64 `json:"states"`
+	SelfState     string            `json:"self_state,omitempty"`
+	Errors        uint64            `json:"errors"`
+}
+
 func NewMetricHandler(e *event.EventHandler) *MetricsHandler {
 	return &MetricsHandler{
 		event:               e,
@@ -59,17 +136,25 @@ func (m *MetricsHandler) Inc(metric string) {
 		m.ReqCountService += 1
 		m.mxReqService.Unlock()
 	case "requests_hc":
-		m.mxReqService.Lock()
+		m.mxReqHC.Lock()
 		m.ReqCountHC += 1
-		m.mxReqService.Unlock()
+		m.mxReqHC.Unlock()
 	case "requests_client":
 		m.mxReqCli.Lock()
 		m.ReqCountClient += 1
 		m.mxReqCli.Unlock()
+	case "requests_cli_1xx":
+		m.mxReqCli.Lock()
+		m.ReqCountClient1xx += 1
+		m.mxReqCli.Unlock()
 	case "requests_cli_2xx":
 		m.mxReqCli.Lock()
 		m.ReqCountClient2xx += 1
 		m.mxReqCli.Unlock()
+	case "requests_cli_3xx":
+		m.mxReqCli.Lock()
+		m.ReqCountClient3xx += 1
+		m.mxReqCli.Unlock()
 	case "requests_cli_4xx":
 		m.mxReqCli.Lock()
 		m.ReqCountClient4xx += 1
@@ -78,17 +163,369 @@ func (m *MetricsHandler) Inc(metric string) {
 		m.mxReqCli.Lock()
 		m.ReqCountClient5xx += 1
 		m.mxReqCli.Unlock()
+	case "requests_cli_errors":
+		m.mxCliErr.Lock()
+		m.CliErrors += 1
+		m.mxCliErr.Unlock()
+	case "requests_cli_err_dns":
+		m.mxCliErr.Lock()
+		m.CliErrDNS += 1
+		m.mxCliErr.Unlock()
+	case "requests_cli_err_connect_refused":
+		m.mxCliErr.Lock()
+		m.CliErrConnectRefused += 1
+		m.mxCliErr.Unlock()
+	case "requests_cli_err_connect_timeout":
+		m.mxCliErr.Lock()
+		m.CliErrConnectTimeout += 1
+		m.mxCliErr.Unlock()
+	case "requests_cli_err_tls_handshake":
+		m.mxCliErr.Lock()
+		m.CliErrTLSHandshake += 1
+		m.mxCliErr.Unlock()
+	case "requests_cli_err_conn_reset":
+		m.mxCliErr.Lock()
+		m.CliErrConnReset += 1
+		m.mxCliErr.Unlock()
+	case "requests_cli_err_read_timeout":
+		m.mxCliErr.Lock()
+		m.CliErrReadTimeout += 1
+		m.mxCliErr.Unlock()
+	case "requests_cli_err_other":
+		m.mxCliErr.Lock()
+		m.CliErrOther += 1
+		m.mxCliErr.Unlock()
+	case "requests_cli_assert_failed":
+		m.mxCliErr.Lock()
+		m.CliAssertFailed += 1
+		m.mxCliErr.Unlock()
+	case "requests_cli_assert_status":
+		m.mxCliErr.Lock()
+		m.CliAssertStatus += 1
+		m.mxCliErr.Unlock()
+	case "requests_cli_assert_body":
+		m.mxCliErr.Lock()
+		m.CliAssertBody += 1
+		m.mxCliErr.Unlock()
+	case "requests_cli_assert_header":
+		m.mxCliErr.Lock()
+		m.CliAssertHeader += 1
+		m.mxCliErr.Unlock()
+	case "requests_cli_assert_json":
+		m.mxCliErr.Lock()
+		m.CliAssertJSON += 1
+		m.mxCliErr.Unlock()
+	case "requests_cli_assert_latency":
+		m.mxCliErr.Lock()
+		m.CliAssertLatency += 1
+		m.mxCliErr.Unlock()
+	case "tg_api_calls":
+		m.mxTGErr.Lock()
+		m.TGAPICalls += 1
+		m.mxTGErr.Unlock()
+	case "tg_api_retries":
+		m.mxTGErr.Lock()
+		m.TGAPIRetries += 1
+		m.mxTGErr.Unlock()
+	case "tg_errors":
+		m.mxTGErr.Lock()
+		m.TGErrors += 1
+		m.mxTGErr.Unlock()
+	case "tg_err_throttle":
+		m.mxTGErr.Lock()
+		m.TGErrThrottle += 1
+		m.mxTGErr.Unlock()
+	case "tg_err_not_found":
+		m.mxTGErr.Lock()
+		m.TGErrNotFound += 1
+		m.mxTGErr.Unlock()
+	case "tg_err_auth":
+		m.mxTGErr.Lock()
+		m.TGErrAuth += 1
+		m.mxTGErr.Unlock()
+	case "tg_err_other":
+		m.mxTGErr.Lock()
+		m.TGErrOther += 1
+		m.mxTGErr.Unlock()
+	case "tcp_cli_messages":
+		m.mxTCPCli.Lock()
+		m.ReqCountTCPClient += 1
+		m.mxTCPCli.Unlock()
+	case "tcp_cli_conn_opened":
+		m.mxTCPCli.Lock()
+		m.TCPClientConnOpened += 1
+		m.mxTCPCli.Unlock()
+	case "tcp_cli_conn_closed":
+		m.mxTCPCli.Lock()
+		m.TCPClientConnClosed += 1
+		m.mxTCPCli.Unlock()
+	case "tcp_cli_dial_errors":
+		m.mxTCPCli.Lock()
+		m.TCPClientDialErrors += 1
+		m.mxTCPCli.Unlock()
+	case "tcp_cli_resets":
+		m.mxTCPCli.Lock()
+		m.TCPClientResets += 1
+		m.mxTCPCli.Unlock()
+	case "tcp_cli_timeouts":
+		m.mxTCPCli.Lock()
+		m.TCPClientTimeouts += 1
+		m.mxTCPCli.Unlock()
+	case "tcp_cli_eof":
+		m.mxTCPCli.Lock()
+		m.TCPClientEOF += 1
+		m.mxTCPCli.Unlock()
+	case "tcp_cli_errors":
+		m.mxTCPCli.Lock()
+		m.TCPClientErrors += 1
+		m.mxTCPCli.Unlock()
 	}
 
 	return
 }
 
+// SetTCPClientRTT sets the last round trip time measured by
+// the TCP client.
+func (m *MetricsHandler) SetTCPClientRTT(ms float64) {
+	m.mxTCPCli.Lock()
+	m.TCPClientRTTMs = ms
+	m.mxTCPCli.Unlock()
+}
+
+// IncClientBackend counts the client response served by
+// the backend instance.
+func (m *MetricsHandler) IncClientBackend(instance string) {
+	m.mxReqCli.Lock()
+	if m.ClientBackends == nil {
+		m.ClientBackends = make(map[string]uint64)
+	}
+	m.ClientBackends[instance] += 1
+	m.mxReqCli.Unlock()
+}
+
+// SetAppCheck updates the state of one readiness check of the
+// application, counting the transitions.
+func (m *MetricsHandler) SetAppCheck(name string, ok bool) {
+	m.mxGlobal.Lock()
+	defer m.mxGlobal.Unlock()
+	if m.AppChecks == nil {
+		m.AppChecks = make(map[string]bool)
+		m.AppCheckTransitions = make(map[string]uint64)
+	}
+	if prev, found := m.AppChecks[name]; found && prev != ok {
+		m.AppCheckTransitions[name] += 1
+	}
+	m.AppChecks[name] = ok
+}
+
+// SetAppState updates the application state metrics.
+func (m *MetricsHandler) SetAppState(healthy, termination bool) {
+	m.mxGlobal.Lock()
+	m.AppHealthy = healthy
+	m.AppTermination = termination
+	m.mxGlobal.Unlock()
+}
+
+// GetAppState returns the application state metrics.
+func (m *MetricsHandler) GetAppState() (healthy, termination bool) {
+	m.mxGlobal.Lock()
+	defer m.mxGlobal.Unlock()
+	return m.AppHealthy, m.AppTermination
+}
+
+// Traffic is a snapshot of the traffic counters, served by the
+// service and generated by the client.
+type Traffic struct {
+	ServiceRequests uint64 `json:"reqc_service"`
+	Connections     uint64 `json:"conn_total"`
+	ClientRequests  uint64 `json:"reqc_client"`
+	ClientErrors    uint64 `json:"reqc_client_errors"`
+}
+
+// Sub returns the traffic since the previous snapshot.
+func (t Traffic) Sub(prev Traffic) Traffic {
+	return Traffic{
+		ServiceRequests: t.ServiceRequests - prev.ServiceRequests,
+		Connections:     t.Connections - prev.Connections,
+		ClientRequests:  t.ClientRequests - prev.ClientRequests,
+		ClientErrors:    t.ClientErrors - prev.ClientErrors,
+	}
+}
+
+// GetTraffic returns the snapshot of the traffic counters.
+func (m *MetricsHandler) GetTraffic() Traffic {
+	t := Traffic{}
+	m.mxReqService.Lock()
+	t.ServiceRequests = m.ReqCountService
+	m.mxReqService.Unlock()
+	m.mxConn.Lock()
+	t.Connections = m.ConnTotal
+	m.mxConn.Unlock()
+	m.mxReqCli.Lock()
+	t.ClientRequests = m.ReqCountClient
+	m.mxReqCli.Unlock()
+	m.mxCliErr.Lock()
+	t.ClientErrors = m.CliErrors
+	m.mxCliErr.Unlock()
+	return t
+}
+
+// targetGroup returns the metrics of the target group, the global
+// lock must be held.
+func (m *MetricsHandler) targetGroup(name string) *TargetGroupMetrics {
+	if m.TargetGroups == nil {
+		m.TargetGroups = make(map[string]*TargetGroupMetrics)
+	}
+	tg, ok := m.TargetGroups[name]
+	if !ok {
+		tg = &TargetGroupMetrics{}
+		m.TargetGroups[name] = tg
+	}
+	return tg
+}
+
+// SetTargetGroupStates sets the amount of targets in each state of
+// the target group, updating the global target metrics with the sum
+// of all target groups. The targets not healthy are counted as
+// unhealthy.
+func (m *MetricsHandler) SetTargetGroupStates(name string, counts map[string]uint64) {
+	states := map[string]uint64{
+		"healthy":     0,
+		"unhealthy":   0,
+		"draining":    0,
+		"initial":     0,
+		"unused":      0,
+		"unavailable": 0,
+	}
+	total := uint64(0)
+	for state, count := range counts {
+		states[state] = count
+		total += count
+	}
+
+	m.mxGlobal.Lock()
+	defer m.mxGlobal.Unlock()
+	tg := m.targetGroup(name)
+	tg.States = states
+	tg.HealthCount = states["healthy"]
+	tg.UnhealthCount = total - states["healthy"]
+	tg.Healthy = tg.UnhealthCount == 0
+
+	global := map[string]uint64{}
+	m.TargetHealthy = true
+	m.TargetHealthCount = 0
+	m.TargetUnhealthCount = 0
+	for _, tg := range m.TargetGroups {
+		for state, count := range tg.States {
+			global[state] += count
+		}
+		m.TargetHealthy = m.TargetHealthy && tg.Healthy
+		m.TargetHealthCount += tg.HealthCount
+		m.TargetUnhealthCount += tg.UnhealthCount
+	}
+	m.TargetStates = global
+}
+
+// SetTargetGroupSelf sets the state of this instance target on the
+// target group. The global state is healthy when the target is
+// healthy on all the target groups it is registered, otherwise it is
+// the state of the first target group (by name) where it is not.
+func (m *MetricsHandler) SetTargetGroupSelf(name, state string) {
+	m.mxGlobal.Lock()
+	defer m.mxGlobal.Unlock()
+	m.targetGroup(name).SelfState = state
+
+	names := make([]string, 0, len(m.TargetGroups))
+	for n := range m.TargetGroups {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	global := ""
+	for _, n := range names {
+		switch self := m.TargetGroups[n].SelfState; self {
+		case "":
+		case "unregistered":
+			if global == "" {
+				global = self
+			}
+		case "healthy":
+			if global == "" || global == "unregistered" {
+				global = self
+			}
+		default:
+			m.SelfTargetState = self
+			return
+		}
+	}
+	m.SelfTargetState = global
+}
+
+// IncTargetGroupError counts an error describing the target group.
+func (m *MetricsHandler) IncTargetGroupError(name string) {
+	m.mxGlobal.Lock()
+	m.targetGroup(name).Errors += 1
+	m.mxGlobal.Unlock()
+}
+
+// ConnOpened counts a new connection accepted by the servers.
+func (m *MetricsHandler) ConnOpened() {
+	m.mxConn.Lock()
+	m.ConnOpen += 1
+	m.ConnTotal += 1
+	m.mxConn.Unlock()
+}
+
+// ConnClosed counts a connection closed by the reason, and the bytes
+// transferred on it.
+func (m *MetricsHandler) ConnClosed(reason string, bytesIn, bytesOut uint64) {
+	m.mxConn.Lock()
+	defer m.mxConn.Unlock()
+	m.ConnOpen -= 1
+	m.ConnBytesIn += bytesIn
+	m.ConnBytesOut += bytesOut
+	switch reason {
+	case "client-fin":
+		m.ConnClosedClientFin += 1
+	case "client-rst":
+		m.ConnClosedClientRst += 1
+	case "idle-timeout":
+		m.ConnClosedIdleTimeout += 1
+	default:
+		m.ConnClosedServerClose += 1
+	}
+}
+
+// marshal builds the metrics holding all locks, so the
+// snapshot is consistent.
+func (m *MetricsHandler) marshal() ([]byte, error) {
+	m.mxGlobal.Lock()
+	m.mxReqService.Lock()
+	m.mxReqHC.Lock()
+	m.mxReqCli.Lock()
+	m.mxCliErr.Lock()
+	m.mxTGErr.Lock()
+	m.mxTCPCli.Lock()
+	m.mxConn.Lock()
+	defer func() {
+		m.mxConn.Unlock()
+		m.mxTCPCli.Unlock()
+		m.mxTGErr.Unlock()
+		m.mxCliErr.Unlock()
+		m.mxReqCli.Unlock()
+		m.mxReqHC.Unlock()
+		m.mxReqService.Unlock()
+		m.mxGlobal.Unlock()
+	}()
+	m.Time = time.Now()
+	return json.Marshal(m)
+}
+
 // StartPush is a routing to dump/push metrics to
 // anywhere (ToDo). Only stdout is supported atm.
 func (m *MetricsHandler) StartPusher() {
 	for {
-		m.Time = time.Now()
-		data, err := json.Marshal(m)
+		data, err := m.marshal()
 		if err != nil {
 			log.Println("Error building metrics...")
 			time.Sleep(5 * time.Second)
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Close reasons of tracked connections.
+const (
+	CloseReasonClientFin   = "client-fin"
+	CloseReasonClientRst   = "client-rst"
+	CloseReasonServerClose = "server-close"
+	CloseReasonIdleTimeout = "idle-timeout"
+)
+
+// connTracker keeps track of the connections accepted by one server,
+// closing the connections without activity after the idle timeout.
+type connTracker struct {
+	config *ServerConfig
+
+	locker sync.Mutex
+	conns  map[*trackedConn]struct{}
+}
+
+// trackedConn counts the bytes and the last activity of the
+// connection, registering the close reason.
+type trackedConn struct {
+	// 64-bit atomic counters must be aligned
+	bytesIn      uint64
+	bytesOut     uint64
+	lastActivity int64
+
+	net.Conn
+	tracker  *connTracker
+	openTime time.Time
+
+	locker      sync.Mutex
+	closeReason string
+	closeOnce   sync.Once
+}
+
+// ConnEvent is the event sent when the connection is closed.
+type ConnEvent struct {
+	Server       string    `json:"server"`
+	RemoteAddr   string    `json:"remote_addr"`
+	LocalAddr    string    `json:"local_addr"`
+	OpenTime     time.Time `json:"open_time"`
+	CloseTime    time.Time `json:"close_time"`
+	LastActivity time.Time `json:"last_activity"`
+	DurationMs   int64     `json:"duration_ms"`
+	BytesIn      uint64    `json:"bytes_in"`
+	BytesOut     uint64    `json:"bytes_out"`
+	Reason       string    `json:"reason"`
+}
+
+func newConnTracker(cfg *ServerConfig) *connTracker {
+	ct := connTracker{
+		config: cfg,
+		conns:  make(map[*trackedConn]struct{}),
+	}
+	if cfg.connOpts.idleTimeout > 0 {
+		go ct.runIdleSweeper()
+	}
+	return &ct
+}
+
+// Listener wraps the listener to track the accepted connections.
+func (ct *connTracker) Listener(ln net.Listener) net.Listener {
+	return &trackedListener{Listener: ln, tracker: ct}
+}
+
+// Track starts tracking the connection.
+func (ct *connTracker) Track(conn net.Conn) net.Conn {
+	now := time.Now()
+	tc := &trackedConn{
+		Conn:         conn,
+		tracker:      ct,
+		openTime:     now,
+		lastActivity: now.UnixNano(),
+	}
+	ct.locker.Lock()
+	ct.conns[tc] = struct{}{}
+	ct.locker.Unlock()
+	ct.config.metric.ConnOpened()
+	return tc
+}
+
+func (ct *connTracker) untrack(tc *trackedConn) {
+	ct.locker.Lock()
+	delete(ct.conns, tc)
+	ct.locker.Unlock()
+}
+
+// runIdleSweeper closes the connections idle for longer
+// than the idle timeout.
+func (ct *connTracker) runIdleSweeper() {
+	interval := ct.config.connOpts.idleTimeout / 10
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	if interval > time.Second {
+		interval = time.Second
+	}
+	for {
+		time.Sleep(interval)
+		idle := []*trackedConn{}
+		ct.locker.Lock()
+		for tc := range ct.conns {
+			if tc.idleTime() >= ct.config.connOpts.idleTimeout {
+				idle = append(idle, tc)
+			}
+		}
+		ct.locker.Unlock()
+
+		for _, tc := range idle {
+			tc.setCloseReason(CloseReasonIdleTimeout)
+			tc.Close()
+		}
+	}
+}
+
+type trackedListener struct {
+	net.Listener
+	tracker *connTracker
+}
+
+func (tl *trackedListener) Accept() (net.Conn, error) {
+	conn, err := tl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return tl.tracker.Track(conn), nil
+}
+
+func (tc *trackedConn) Read(b []byte) (int, error) {
+	n, err := tc.Conn.Read(b)
+	if n > 0 {
+		atomic.AddUint64(&tc.bytesIn, uint64(n))
+		atomic.StoreInt64(&tc.lastActivity, time.Now().UnixNano())
+	}
+	if err != nil {
+		tc.setCloseReasonFromErr(err)
+	}
+	return n, err
+}
+
+func (tc *trackedConn) Write(b []byte) (int, error) {
+	n, err := tc.Conn.Write(b)
+	if n > 0 {
+		atomic.AddUint64(&tc.bytesOut, uint64(n))
+		atomic.StoreInt64(&tc.lastActivity, time.Now().UnixNano())
+	}
+	if err != nil {
+		tc.setCloseReasonFromErr(err)
+	}
+	return n, err
+}
+
+// Close closes the connection, registering the metrics
+// and sending the close event once.
+func (tc *trackedConn) Close() error {
+	err := tc.Conn.Close()
+	tc.closeOnce.Do(func() {
+		tc.setCloseReason(CloseReasonServerClose)
+		tc.tracker.untrack(tc)
+		tc.report()
+	})
+	return err
+}
+
+// NetConn returns the underlying connection.
+func (tc *trackedConn) NetConn() net.Conn {
+	return tc.Conn
+}
+
+func (tc *trackedConn) idleTime() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&tc.lastActivity)))
+}
+
+// setCloseReason register the first reason detected.
+func (tc *trackedConn) setCloseReason(reason string) {
+	tc.locker.Lock()
+	if tc.closeReason == "" {
+		tc.closeReason = reason
+	}
+	tc.locker.Unlock()
+}
+
+func (tc *trackedConn) setCloseReasonFromErr(err error) {
+	switch {
+	case errors.Is(err, io.EOF):
+		tc.setCloseReason(CloseReasonClientFin)
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		tc.setCloseReason(CloseReasonClientRst)
+	}
+}
+
+func (tc *trackedConn) report() {
+	now := time.Now()
+	tc.locker.Lock()
+	reason := tc.closeReason
+	tc.locker.Unlock()
+
+	ev := ConnEvent{
+		Server:       tc.tracker.config.name,
+		RemoteAddr:   tc.RemoteAddr().String(),
+		LocalAddr:    tc.LocalAddr().String(),
+		OpenTime:     tc.openTime,
+		CloseTime:    now,
+		LastActivity: time.Unix(0, atomic.LoadInt64(&tc.lastActivity)),
+		DurationMs:   now.Sub(tc.openTime).Milliseconds(),
+		BytesIn:      atomic.LoadUint64(&tc.bytesIn),
+		BytesOut:     atomic.LoadUint64(&tc.bytesOut),
+		Reason:       reason,
+	}
+	tc.tracker.config.metric.ConnClosed(reason, ev.BytesIn, ev.BytesOut)
+
+	data, err := json.Marshal(&ev)
+	if err != nil {
+		return
+	}
+	tc.tracker.config.event.Send("conn", tc.tracker.config.name, string(data))
+}
@@ -1,27 +1,91 @@
 package server
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	"sync"
-
 	"github.com/mtulio/go-lab-api/internal/event"
 	"github.com/mtulio/go-lab-api/internal/metric"
 )
 
-type HealthCheckController struct {
-	// Healthy flag. Return true when the termination
-	// flag is not set.
-	Healthy bool
+// HCState is the state of the Health Check Controller.
+type HCState uint8
+
+const (
+	// Health check is passing.
+	StateHealthy HCState = iota
+	// Health check is failing, without termination.
+	StateUnhealthy
+	// Termination started, health check is passing
+	// until the pre-stop delay is finished.
+	StateTerminating
+	// Termination in progress, health check is failing
+	// until the termination timeout.
+	StateDraining
+)
+
+// hcTransitions is the set of allowed transitions from each state.
+var hcTransitions = map[HCState][]HCState{
+	StateHealthy:     {StateUnhealthy, StateTerminating, StateDraining},
+	StateUnhealthy:   {StateHealthy, StateDraining},
+	StateTerminating: {StateHealthy, StateDraining},
+	StateDraining:    {StateHealthy},
+}
+
+var errTerminationInProgress = errors.New("termination already in progress")
+
+func (s HCState) String() string {
+	switch s {
+	case StateHealthy:
+		return "healthy"
+	case StateUnhealthy:
+		return "unhealthy"
+	case StateTerminating:
+		return "terminating"
+	case StateDraining:
+		return "draining"
+	}
+	return "unknown"
+}
+
+// Healthy returns true when the health check should pass.
+func (s HCState) Healthy() bool {
+	return s == StateHealthy || s == StateTerminating
+}
 
-	HealthSince   time.Time
-	UnhealthSince time.Time
+// Terminating returns true when termination is in progress.
+func (s HCState) Terminating() bool {
+	return s == StateTerminating || s == StateDraining
+}
+
+func (s HCState) canTransitionTo(to HCState) bool {
+	for _, st := range hcTransitions[s] {
+		if st == to {
+			return true
+		}
+	}
+	return false
+}
+
+// HCStateChange is sent to the subscribers on every state change.
+type HCStateChange struct {
+	From   HCState
+	To     HCState
+	Time   time.Time
+	Reason string
+}
 
-	// Return true when termination is in Progress
-	terminationInProgress bool
+type HealthCheckController struct {
+	state HCState
+
+	healthSince   time.Time
+	unhealthSince time.Time
 
 	// Timeout in seconds that Termination flag should be set
 	terminationTimeout float64
@@ -30,9 +94,32 @@ type HealthCheckController struct {
 	// flag is set. It should not be 0.
 	terminationStartTime time.Time
 
-	//events *chan string
+	// Sequence of terminations, timers from previous
+	// terminations are ignored.
+	terminationID uint64
+	timers        []*time.Timer
+
+	// Delay in seconds, after termination starts, to go unhealthy
+	preStopDelay float64
+
+	// Deadline in seconds, after termination starts, to exit the
+	// process. 0 is disabled. The timer is kept when the termination
+	// is finished, the deadline is not reset by a new termination.
+	hardDeadline  float64
+	deadlineTimer *time.Timer
+
+	// Exit the process when termination timeout is reached, instead
+	// of restoring the healthy state.
+	exitOnTimeout bool
+
+	// Actions triggered by each signal
+	signalActions map[os.Signal]SignalAction
+
+	// Called before the process exits, eg: to cancel the context
+	// of the watchers.
+	onExit func()
 
-	//termChan chan os.Signal
+	subscribers []chan HCStateChange
 
 	// mutex
 	locker sync.Mutex
@@ -43,130 +130,386 @@ type HealthCheckController struct {
 }
 
 type HCControllerOpts struct {
-	Event       *event.EventHandler
-	Metric      *metric.MetricsHandler
-	TermTimeout uint64
+	Event         *event.EventHandler
+	Metric        *metric.MetricsHandler
+	TermTimeout   uint64
+	PreStopDelay  uint64
+	HardDeadline  uint64
+	ExitOnTimeout bool
+	SignalActions map[os.Signal]SignalAction
+	OnExit        func()
+}
+
+// SignalAction is the action taken when a signal is received.
+type SignalAction string
+
+const (
+	// Start the termination: pre-stop delay, unhealthy and timeout.
+	ActionTerminate SignalAction = "terminate"
+	// Restore to healthy state, clearing the termination.
+	ActionHealthy SignalAction = "healthy"
+	// Set unhealthy state, without starting the termination.
+	ActionUnhealthy SignalAction = "unhealthy"
+	// Toggle between healthy and unhealthy states.
+	ActionToggleHealth SignalAction = "toggle-health"
+	// Exit the process immediately.
+	ActionExit SignalAction = "exit"
+	// Ignore the signal.
+	ActionIgnore SignalAction = "ignore"
+)
+
+var signalNames = map[string]os.Signal{
+	"SIGTERM": syscall.SIGTERM,
+	"SIGINT":  syscall.SIGINT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// DefaultSignalActions returns the actions taken by the controller
+// when no custom mapping is set.
+func DefaultSignalActions() map[os.Signal]SignalAction {
+	return map[os.Signal]SignalAction{
+		syscall.SIGTERM: ActionTerminate,
+		syscall.SIGINT:  ActionExit,
+		syscall.SIGHUP:  ActionHealthy,
+		syscall.SIGUSR1: ActionToggleHealth,
+		syscall.SIGUSR2: ActionUnhealthy,
+	}
+}
+
+// ParseSignalActions overrides the default signal actions with the
+// comma-separated mapping in the format SIGNAL=action.
+// Eg: SIGUSR1=toggle-health,SIGHUP=ignore
+func ParseSignalActions(mapping string) (map[os.Signal]SignalAction, error) {
+	actions := DefaultSignalActions()
+	if mapping == "" {
+		return actions, nil
+	}
+	for _, m := range strings.Split(mapping, ",") {
+		kv := strings.SplitN(m, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid signal action [%s], expected SIGNAL=action", m)
+		}
+		name := strings.ToUpper(strings.TrimSpace(kv[0]))
+		if !strings.HasPrefix(name, "SIG") {
+			name = "SIG" + name
+		}
+		sig, ok := signalNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported signal [%s]", kv[0])
+		}
+		action := SignalAction(strings.TrimSpace(kv[1]))
+		switch action {
+		case ActionTerminate, ActionHealthy, ActionUnhealthy,
+			ActionToggleHealth, ActionExit, ActionIgnore:
+		default:
+			return nil, fmt.Errorf("unsupported action [%s] for signal %s", kv[1], name)
+		}
+		actions[sig] = action
+	}
+	return actions, nil
 }
 
 func NewHealthCheckController(op *HCControllerOpts) *HealthCheckController {
 
 	hc := HealthCheckController{
-		Healthy:               true,
-		terminationInProgress: false,
-		//terminationTimeout:    (time.Duration(float64(op.TermTimeout)) * time.Second),
+		state:              StateHealthy,
+		healthSince:        time.Now(),
 		terminationTimeout: float64(op.TermTimeout),
+		preStopDelay:       float64(op.PreStopDelay),
+		hardDeadline:       float64(op.HardDeadline),
+		exitOnTimeout:      op.ExitOnTimeout,
+		signalActions:      op.SignalActions,
+		onExit:             op.OnExit,
 		Event:              op.Event,
 		Metric:             op.Metric,
 	}
-	hc.Metric.AppHealthy = hc.Healthy
-	hc.Metric.AppTermination = hc.terminationInProgress
+	if hc.signalActions == nil {
+		hc.signalActions = DefaultSignalActions()
+	}
+	hc.Metric.SetAppState(hc.state.Healthy(), hc.state.Terminating())
 	return &hc
 }
 
 func (hc *HealthCheckController) Start() {
+	go hc.runMetricUpdater(hc.Subscribe())
 	go hc.runSignalHandler()
-	go hc.runTicker()
 }
 
-func (hc *HealthCheckController) GetHealthy() bool {
-	return hc.Healthy
+// Subscribe returns a channel notified on every state change. The
+// current state is sent first, so the subscriber can sync up.
+func (hc *HealthCheckController) Subscribe() <-chan HCStateChange {
+	ch := make(chan HCStateChange, 16)
+
+	hc.locker.Lock()
+	defer hc.locker.Unlock()
+	ch <- HCStateChange{
+		From:   hc.state,
+		To:     hc.state,
+		Time:   time.Now(),
+		Reason: "subscribed",
+	}
+	hc.subscribers = append(hc.subscribers, ch)
+	return ch
 }
 
-// Returns healthy/unhealthy string
-func (hc *HealthCheckController) GetHealthyStr() string {
-	if hc.Healthy {
-		return "healthy"
+// notify delivers the change to subscribers. Must be called
+// with lock held.
+func (hc *HealthCheckController) notify(change HCStateChange) {
+	NotifySubscribers(hc.subscribers, change)
+}
+
+// NotifySubscribers delivers the change to subscribers without
+// blocking the sender. When a subscriber is too slow, the oldest
+// change is dropped to keep the latest state.
+func NotifySubscribers(subscribers []chan HCStateChange, change HCStateChange) {
+	for _, ch := range subscribers {
+		select {
+		case ch <- change:
+		default:
+			select {
+			case <-ch:
+			default:
+			}
+			select {
+			case ch <- change:
+			default:
+			}
+		}
 	}
-	return "unhealthy"
 }
 
-func (hc *HealthCheckController) StartHealth() {
-	// when state is changed to healthy, all
-	// termination operations will be clear
+// setState runs the transition to the state. Must be called
+// with lock held.
+func (hc *HealthCheckController) setState(to HCState, reason string) (*HCStateChange, error) {
+	from := hc.state
+	if from == to {
+		return nil, nil
+	}
+	if !from.canTransitionTo(to) {
+		return nil, fmt.Errorf("invalid transition from %s to %s", from, to)
+	}
+
+	now := time.Now()
+	hc.state = to
+	if from.Healthy() && !to.Healthy() {
+		hc.unhealthSince = now
+	}
+	if !from.Healthy() && to.Healthy() {
+		hc.healthSince = now
+	}
+
+	// Leaving the termination clear the pending timers
+	if from.Terminating() && !to.Terminating() {
+		for _, t := range hc.timers {
+			t.Stop()
+		}
+		hc.timers = nil
+	}
+
+	change := HCStateChange{
+		From:   from,
+		To:     to,
+		Time:   now,
+		Reason: reason,
+	}
+	hc.notify(change)
+	return &change, nil
+}
+
+// transition runs the state transition and send the event.
+func (hc *HealthCheckController) transition(to HCState, reason string) error {
 	hc.locker.Lock()
-	hc.Healthy = true
-	hc.HealthSince = time.Now()
-	hc.Metric.AppHealthy = hc.Healthy
+	change, err := hc.setState(to, reason)
 	hc.locker.Unlock()
+	hc.sendChange(change)
+	return err
+}
+
+func (hc *HealthCheckController) sendChange(change *HCStateChange) {
+	if change == nil {
+		return
+	}
+	msg := fmt.Sprintf("State changed from %s to %s: %s", change.From, change.To, change.Reason)
+	hc.Event.Send("runtime", "hc-controller", msg)
 }
 
-func (hc *HealthCheckController) StartUnhealth() {
+// GetState returns the current state of the controller.
+func (hc *HealthCheckController) GetState() HCState {
 	hc.locker.Lock()
+	defer hc.locker.Unlock()
+	return hc.state
+}
 
-	// Set Start time only when Unhealthy is started
-	if hc.Healthy {
-		hc.UnhealthSince = time.Now()
+func (hc *HealthCheckController) GetHealthy() bool {
+	return hc.GetState().Healthy()
+}
+
+// Returns healthy/unhealthy string
+func (hc *HealthCheckController) GetHealthyStr() string {
+	if hc.GetHealthy() {
+		return "healthy"
 	}
-	hc.Healthy = false
-	hc.Metric.AppHealthy = hc.Healthy
-	hc.locker.Unlock()
+	return "unhealthy"
 }
 
-func (hc *HealthCheckController) StartTermination() {
-	hc.locker.Lock()
-	hc.terminationInProgress = true
-	hc.terminationStartTime = time.Now()
-	hc.Metric.AppTermination = hc.terminationInProgress
-	hc.locker.Unlock()
+// StartHealth sets the healthy state, when state is changed
+// to healthy, all termination operations will be clear.
+func (hc *HealthCheckController) StartHealth() error {
+	return hc.transition(StateHealthy, "health restored")
 }
 
-func (hc *HealthCheckController) StopTermination() {
+// StartUnhealth sets the unhealthy state. When termination is in
+// progress the pre-stop delay is skipped.
+func (hc *HealthCheckController) StartUnhealth() error {
 	hc.locker.Lock()
-	hc.terminationInProgress = false
-	hc.Metric.AppTermination = hc.terminationInProgress
+	to := StateUnhealthy
+	if hc.state.Terminating() {
+		to = StateDraining
+	}
+	change, err := hc.setState(to, "health check set to fail")
 	hc.locker.Unlock()
+	hc.sendChange(change)
+	return err
 }
 
-// Handle SiGTERM signal, if it was sent twice the termination
-// will be forced. Otherwise the timeout ticket will clear the
-// process for a while.
-func (hc *HealthCheckController) runSignalHandler() {
+// StartTermination starts the termination: the health check
+// starts to fail after the pre-stop delay, until the termination
+// timeout is reached.
+func (hc *HealthCheckController) StartTermination() error {
+	hc.locker.Lock()
+	if hc.state.Terminating() {
+		hc.locker.Unlock()
+		return errTerminationInProgress
+	}
 
-	for {
-		msg := ("Running Signal handler")
-		hc.Event.Send("runtime", "hc-controller", msg)
+	to := StateDraining
+	reason := "termination started"
+	if hc.state == StateHealthy && hc.preStopDelay > 0 {
+		to = StateTerminating
+		reason = fmt.Sprintf("termination started, waiting pre-stop delay of %.0fs", hc.preStopDelay)
+	}
+	change, err := hc.setState(to, reason)
+	if err != nil {
+		hc.locker.Unlock()
+		return err
+	}
+	hc.terminationStartTime = change.Time
+	hc.terminationID += 1
+	id := hc.terminationID
+
+	if to == StateTerminating {
+		hc.afterTermination(id, hc.preStopDelay, func() {
+			hc.transitionTermination(id, StateDraining, "pre-stop delay finished")
+		})
+	}
 
-		termChan := make(chan os.Signal)
-		signal.Notify(termChan, syscall.SIGTERM)
+	// Timeout (arg --termination-timeout)
+	hc.afterTermination(id, hc.terminationTimeout, func() {
+		if hc.exitOnTimeout {
+			hc.exit(fmt.Sprintf("Termination: timeout of %.0fs reached, exiting.", hc.terminationTimeout))
+		}
+		hc.transitionTermination(id, StateHealthy, "termination timeout reached")
+	})
+
+	// Hard deadline (arg --termination-hard-deadline), the process
+	// exits even when the termination timeout restored the health.
+	if hc.hardDeadline > 0 && hc.deadlineTimer == nil {
+		hc.deadlineTimer = time.AfterFunc(time.Duration(hc.hardDeadline*float64(time.Second)), func() {
+			hc.exit(fmt.Sprintf("Termination: hard deadline of %.0fs reached, exiting.", hc.hardDeadline))
+		})
+	}
+	hc.locker.Unlock()
 
-		<-termChan
+	hc.sendChange(change)
+	return nil
+}
 
-		msg = ("Termination Signal receievd")
-		hc.Event.Send("runtime", "hc-controller", msg)
+// exit sends the message and exits the process, after the exit hook
+// and the events are flushed.
+func (hc *HealthCheckController) exit(msg string) {
+	hc.Event.Send("runtime", "hc-controller", msg)
+	if hc.onExit != nil {
+		hc.onExit()
+	}
+	hc.Event.Close()
+	os.Exit(0)
+}
 
-		if hc.terminationInProgress {
-			msg = ("Termination already in progress, forcing termination.")
-			hc.Event.Send("runtime", "hc-controller", msg)
-			os.Exit(0)
+// afterTermination schedules the function to run after the delay
+// in seconds, when the termination is still the current one. Must
+// be called with lock held.
+func (hc *HealthCheckController) afterTermination(id uint64, delay float64, fn func()) {
+	t := time.AfterFunc(time.Duration(delay*float64(time.Second)), func() {
+		hc.locker.Lock()
+		current := hc.state.Terminating() && hc.terminationID == id
+		hc.locker.Unlock()
+		if current {
+			fn()
 		}
+	})
+	hc.timers = append(hc.timers, t)
+}
 
-		hc.StartTermination()
-		hc.StartUnhealth()
+// transitionTermination runs the transition only when the
+// termination is still the current one.
+func (hc *HealthCheckController) transitionTermination(id uint64, to HCState, reason string) {
+	hc.locker.Lock()
+	if !hc.state.Terminating() || hc.terminationID != id {
+		hc.locker.Unlock()
+		return
+	}
+	change, _ := hc.setState(to, reason)
+	hc.locker.Unlock()
+	hc.sendChange(change)
+}
 
-		termChan = make(chan os.Signal)
-		signal.Notify(termChan, syscall.SIGTERM)
+// runMetricUpdater keeps the application metrics in sync
+// with the controller state.
+func (hc *HealthCheckController) runMetricUpdater(changes <-chan HCStateChange) {
+	for change := range changes {
+		hc.Metric.SetAppState(change.To.Healthy(), change.To.Terminating())
 	}
 }
 
-// Run Termination checker until timeout, then reset to
-// Healthy state
-func (hc *HealthCheckController) runTicker() {
+// Handle the signals according to the actions mapped to each one.
+// When SIGTERM (terminate action) was sent twice the termination
+// will be forced. Otherwise the termination timeout will restore
+// the healthy state.
+func (hc *HealthCheckController) runSignalHandler() {
+	msg := ("Running Signal handler")
+	hc.Event.Send("runtime", "hc-controller", msg)
+
+	sigChan := make(chan os.Signal, 1)
+	for sig := range hc.signalActions {
+		signal.Notify(sigChan, sig)
+	}
 
 	for {
-		if !(hc.terminationInProgress) {
-			time.Sleep(5 * time.Second)
-			continue
-		}
+		sig := <-sigChan
+		action := hc.signalActions[sig]
+
+		msg = fmt.Sprintf("Signal %v received, action: %s", sig, action)
+		hc.Event.Send("runtime", "hc-controller", msg)
 
-		// Timeout (arg --termination-timeout)
-		if time.Since(hc.terminationStartTime).Seconds() >= hc.terminationTimeout {
-			//log.Println("Restoring to Healthy state...")
-			hc.Event.Send("runtime", "hc-controller", "Restoring to Health State")
+		switch action {
+		case ActionTerminate:
+			if hc.StartTermination() == errTerminationInProgress {
+				hc.exit("Termination already in progress, forcing termination.")
+			}
+		case ActionHealthy:
 			hc.StartHealth()
-			hc.StopTermination()
+		case ActionUnhealthy:
+			hc.StartUnhealth()
+		case ActionToggleHealth:
+			if hc.GetHealthy() {
+				hc.StartUnhealth()
+			} else {
+				hc.StartHealth()
+			}
+		case ActionExit:
+			hc.exit("Exiting.")
 		}
-
-		time.Sleep(1 * time.Second)
 	}
-
 }
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mtulio/go-lab-api/internal/event"
+	"github.com/mtulio/go-lab-api/internal/metric"
+)
+
+func newTestController(t *testing.T) *HealthCheckController {
+	ev := event.NewEventHandler("test", filepath.Join(t.TempDir(), "events.log"))
+	return NewHealthCheckController(&HCControllerOpts{
+		Event:  ev,
+		Metric: metric.NewMetricHandler(nil),
+	})
+}
+
+// waitState waits the controller to be on the state.
+func waitState(t *testing.T, hc *HealthCheckController, state HCState) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for hc.GetState() != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("state is %s, expected %s", hc.GetState(), state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTransitions(t *testing.T) {
+	hc := newTestController(t)
+	tests := []struct {
+		name     string
+		fn       func() error
+		expected HCState
+	}{
+		{"unhealthy", hc.StartUnhealth, StateUnhealthy},
+		{"healthy", hc.StartHealth, StateHealthy},
+		{"healthy again", hc.StartHealth, StateHealthy},
+		{"termination", hc.StartTermination, StateDraining},
+		{"unhealthy while draining", hc.StartUnhealth, StateDraining},
+		{"healthy clears termination", hc.StartHealth, StateHealthy},
+	}
+	for _, tt := range tests {
+		if err := tt.fn(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := hc.GetState(); got != tt.expected {
+			t.Errorf("%s: state is %s, expected %s", tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestRejectedTransitions(t *testing.T) {
+	tests := []struct {
+		from, to HCState
+	}{
+		{StateUnhealthy, StateTerminating},
+		{StateDraining, StateTerminating},
+		{StateDraining, StateUnhealthy},
+		{StateTerminating, StateUnhealthy},
+	}
+	for _, tt := range tests {
+		hc := newTestController(t)
+		hc.state = tt.from
+		hc.locker.Lock()
+		change, err := hc.setState(tt.to, "test")
+		hc.locker.Unlock()
+		if err == nil || change != nil {
+			t.Errorf("transition from %s to %s was accepted", tt.from, tt.to)
+		}
+		if hc.GetState() != tt.from {
+			t.Errorf("state changed to %s on the rejected transition from %s to %s", hc.GetState(), tt.from, tt.to)
+		}
+	}
+}
+
+func TestTermination(t *testing.T) {
+	hc := newTestController(t)
+	hc.preStopDelay = 0.05
+	hc.terminationTimeout = 0.15
+
+	if err := hc.StartTermination(); err != nil {
+		t.Fatal(err)
+	}
+	if hc.GetState() != StateTerminating {
+		t.Fatalf("state is %s, expected %s during the pre-stop delay", hc.GetState(), StateTerminating)
+	}
+	if err := hc.StartTermination(); err != errTerminationInProgress {
+		t.Errorf("second termination returned %v, expected %v", err, errTerminationInProgress)
+	}
+	waitState(t, hc, StateDraining)
+	waitState(t, hc, StateHealthy)
+}
+
+func TestTerminationCanceled(t *testing.T) {
+	hc := newTestController(t)
+	hc.preStopDelay = 0.05
+	hc.terminationTimeout = 0.1
+	changes := hc.Subscribe()
+
+	if err := hc.StartTermination(); err != nil {
+		t.Fatal(err)
+	}
+	if err := hc.StartHealth(); err != nil {
+		t.Fatal(err)
+	}
+	if err := hc.StartUnhealth(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the timers of the canceled termination don't change the state
+	time.Sleep(200 * time.Millisecond)
+	if hc.GetState() != StateUnhealthy {
+		t.Fatalf("state is %s, expected %s", hc.GetState(), StateUnhealthy)
+	}
+	expected := []HCState{StateHealthy, StateTerminating, StateHealthy, StateUnhealthy}
+	for i, state := range expected {
+		change := <-changes
+		if change.To != state {
+			t.Errorf("change %d is to %s, expected %s", i, change.To, state)
+		}
+	}
+	select {
+	case change := <-changes:
+		t.Errorf("unexpected change from %s to %s: %s", change.From, change.To, change.Reason)
+	default:
+	}
+}
+
+func TestSubscribeDropsOldest(t *testing.T) {
+	hc := newTestController(t)
+	changes := hc.Subscribe()
+
+	// the subscriber is not reading, the buffer keeps the latest
+	for i := 0; i < 20; i++ {
+		if i%2 == 0 {
+			hc.StartUnhealth()
+		} else {
+			hc.StartHealth()
+		}
+	}
+	received := []HCStateChange{}
+	for len(changes) > 0 {
+		received = append(received, <-changes)
+	}
+	if len(received) != cap(changes) {
+		t.Fatalf("got %d changes, expected %d", len(received), cap(changes))
+	}
+	if received[0].Reason == "subscribed" {
+		t.Errorf("oldest change was not dropped")
+	}
+	if last := received[len(received)-1]; last.To != StateHealthy || last.To != hc.GetState() {
+		t.Errorf("last change is to %s, expected the current state %s", last.To, hc.GetState())
+	}
+}
+
+func TestConcurrentTransitions(t *testing.T) {
+	hc := newTestController(t)
+	hc.terminationTimeout = 0.01
+	changes := hc.Subscribe()
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-changes:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				switch (i + j) % 4 {
+				case 0:
+					hc.StartUnhealth()
+				case 1:
+					hc.StartHealth()
+				case 2:
+					hc.StartTermination()
+				default:
+					hc.GetHealthy()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(done)
+}
@@ -2,6 +2,8 @@ package server
 
 import (
 	"log"
+	"os"
+	"time"
 
 	"github.com/mtulio/go-lab-api/internal/event"
 	"github.com/mtulio/go-lab-api/internal/metric"
@@ -10,13 +12,25 @@ import (
 type ListenerOptions struct {
 	ServiceProto       Protocol
 	ServicePort        uint64
+	ServiceTCPMode     TCPMode
 	HCProto            Protocol
 	HCPort             uint64
 	HCPath             string
+	HCUnhealthyMode    TCPUnhealthyMode
 	TargetGroupARN     string
 	CertPem            string
 	CertKey            string
 	TerminationTimeout uint64
+	TCPKeepAlive       time.Duration
+	IdleTimeout        time.Duration
+	PreStopDelay       uint64
+	HardDeadline       uint64
+	ExitOnTimeout      bool
+	SignalActions      map[os.Signal]SignalAction
+	OnExit             func()
+	HCInterval         uint64
+	InstanceID         string
+	ProbesSummary      uint64
 	Event              *event.EventHandler
 	Metric             *metric.MetricsHandler
 	Debug              bool
@@ -27,6 +41,7 @@ type Listener struct {
 	serverService Server
 	serverHC      Server
 	controllerHC  *HealthCheckController
+	probes        *ProbeTracker
 	Event         *event.EventHandler
 }
 
@@ -34,14 +49,33 @@ func NewListener(op *ListenerOptions) (*Listener, error) {
 
 	// Create HC Controller
 	ctrl := NewHealthCheckController(&HCControllerOpts{
-		Event:       op.Event,
-		Metric:      op.Metric,
-		TermTimeout: op.TerminationTimeout,
+		Event:         op.Event,
+		Metric:        op.Metric,
+		TermTimeout:   op.TerminationTimeout,
+		PreStopDelay:  op.PreStopDelay,
+		HardDeadline:  op.HardDeadline,
+		ExitOnTimeout: op.ExitOnTimeout,
+		SignalActions: op.SignalActions,
+		OnExit:        op.OnExit,
 	})
 
+	// Create Probe tracker, shared by the servers
+	probes := NewProbeTracker(&ProbeTrackerOpts{
+		Event:            op.Event,
+		ExpectedInterval: time.Duration(op.HCInterval) * time.Second,
+		SummaryInterval:  time.Duration(op.ProbesSummary) * time.Second,
+	})
+
+	// Options of the connections accepted by the servers
+	connOpts := &connOptions{
+		keepAlive:   op.TCPKeepAlive,
+		idleTimeout: op.IdleTimeout,
+	}
+
 	ln := Listener{
 		options:      op,
 		controllerHC: ctrl,
+		probes:       probes,
 		Event:        op.Event,
 	}
 
@@ -52,10 +86,14 @@ func NewListener(op *ListenerOptions) (*Listener, error) {
 			proto:    ProtoTCP,
 			port:     op.ServicePort,
 			hcServer: false,
+			tcpMode:  op.ServiceTCPMode,
 			hc:       ctrl,
+			probes:   probes,
 			event:    op.Event,
 			metric:   op.Metric,
 			debug:    op.Debug,
+			connOpts: connOpts,
+			instance: op.InstanceID,
 		})
 		if err != nil {
 			log.Fatal("ERROR creating Server Service", err)
@@ -68,12 +106,16 @@ func NewListener(op *ListenerOptions) (*Listener, error) {
 			proto:    ProtoTLS,
 			port:     op.ServicePort,
 			hcServer: false,
+			tcpMode:  op.ServiceTCPMode,
 			hc:       ctrl,
+			probes:   probes,
 			event:    op.Event,
 			metric:   op.Metric,
 			certPem:  op.CertPem,
 			certKey:  op.CertKey,
 			debug:    op.Debug,
+			connOpts: connOpts,
+			instance: op.InstanceID,
 		})
 		if err != nil {
 			log.Fatal("ERROR creating Server Service", err)
@@ -87,11 +129,14 @@ func NewListener(op *ListenerOptions) (*Listener, error) {
 			port:     op.ServicePort,
 			hcServer: false,
 			hc:       ctrl,
+			probes:   probes,
 			event:    op.Event,
 			metric:   op.Metric,
 			certPem:  op.CertPem,
 			certKey:  op.CertKey,
 			debug:    op.Debug,
+			connOpts: connOpts,
+			instance: op.InstanceID,
 		})
 		if err != nil {
 			log.Fatal("ERROR creating Server Service", err)
@@ -105,11 +150,14 @@ func NewListener(op *ListenerOptions) (*Listener, error) {
 			port:     op.ServicePort,
 			hcServer: false,
 			hc:       ctrl,
+			probes:   probes,
 			event:    op.Event,
 			metric:   op.Metric,
 			certPem:  op.CertPem,
 			certKey:  op.CertKey,
 			debug:    op.Debug,
+			connOpts: connOpts,
+			instance: op.InstanceID,
 		})
 		if err != nil {
 			log.Fatal("ERROR creating Server Service", err)
@@ -125,10 +173,14 @@ func NewListener(op *ListenerOptions) (*Listener, error) {
 			proto:    ProtoTCP,
 			port:     op.HCPort,
 			hcServer: true,
+			hcMode:   op.HCUnhealthyMode,
 			hc:       ctrl,
+			probes:   probes,
 			event:    op.Event,
 			metric:   op.Metric,
 			debug:    op.Debug,
+			connOpts: connOpts,
+			instance: op.InstanceID,
 		})
 		if err != nil {
 			log.Fatal("ERROR creating Server HC", err)
@@ -141,12 +193,16 @@ func NewListener(op *ListenerOptions) (*Listener, error) {
 			proto:    ProtoTLS,
 			port:     op.HCPort,
 			hcServer: true,
+			hcMode:   op.HCUnhealthyMode,
 			hc:       ctrl,
+			probes:   probes,
 			event:    op.Event,
 			metric:   op.Metric,
 			certPem:  op.CertPem,
 			certKey:  op.CertKey,
 			debug:    op.Debug,
+			connOpts: connOpts,
+			instance: op.InstanceID,
 		})
 		if err != nil {
 			log.Fatal("ERROR creating Server HC", err)
@@ -160,10 +216,13 @@ func NewListener(op *ListenerOptions) (*Listener, error) {
 			port:     op.HCPort,
 			hcServer: true,
 			hc:       ctrl,
+			probes:   probes,
 			hcPath:   op.HCPath,
 			event:    op.Event,
 			metric:   op.Metric,
 			debug:    op.Debug,
+			connOpts: connOpts,
+			instance: op.InstanceID,
 		})
 		if err != nil {
 			log.Fatal("ERROR creating Server HC", err)
@@ -177,12 +236,15 @@ func NewListener(op *ListenerOptions) (*Listener, error) {
 			port:     op.HCPort,
 			hcServer: true,
 			hc:       ctrl,
+			probes:   probes,
 			hcPath:   op.HCPath,
 			event:    op.Event,
 			metric:   op.Metric,
 			certPem:  op.CertPem,
 			certKey:  op.CertKey,
 			debug:    op.Debug,
+			connOpts: connOpts,
+			instance: op.InstanceID,
 		})
 		if err != nil {
 			log.Fatal("ERROR creating Server HC", err)
@@ -193,12 +255,21 @@ func NewListener(op *ListenerOptions) (*Listener, error) {
 	return &ln, nil
 }
 
+// Subscribe returns a channel notified on every state
+// change of the Health Check Controller.
+func (l *Listener) Subscribe() <-chan HCStateChange {
+	return l.controllerHC.Subscribe()
+}
+
 func (l *Listener) Start() error {
 	l.Event.Send("runtime", "listener", "Starting services...")
 
 	// Start Health Check Controller
 	go l.controllerHC.Start()
 
+	// Start Health Check probes summary
+	go l.probes.StartSummary()
+
 	// Start Health Check server
 	go l.serverHC.StartController()
 	go l.serverHC.Start()
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mtulio/go-lab-api/internal/event"
+)
+
+// ProbeTracker keeps track of health check probers (source IPs)
+// observed by the health check servers, measuring the interval
+// between probes and its jitter, so the probe cadence of the
+// Load Balancer can be compared with the Target Group configuration.
+type ProbeTracker struct {
+	locker  sync.Mutex
+	sources map[string]*ProbeSource
+
+	// Health check interval configured on the Target Group.
+	expectedInterval time.Duration
+
+	// Interval to publish the summary event.
+	summaryInterval time.Duration
+
+	event *event.EventHandler
+}
+
+// ProbeSource holds the analytics of one prober.
+type ProbeSource struct {
+	SourceIP        string    `json:"source_ip"`
+	Count           uint64    `json:"count"`
+	FirstSeen       time.Time `json:"first_seen"`
+	LastSeen        time.Time `json:"last_seen"`
+	LastIntervalSec float64   `json:"last_interval_sec"`
+	MinIntervalSec  float64   `json:"min_interval_sec"`
+	MaxIntervalSec  float64   `json:"max_interval_sec"`
+	AvgIntervalSec  float64   `json:"avg_interval_sec"`
+	JitterSec       float64   `json:"jitter_sec"`
+	DriftSec        float64   `json:"drift_sec"`
+
+	// sum of squares of differences from the mean (Welford)
+	m2 float64
+}
+
+// ProbeSummary is the report of active probers.
+type ProbeSummary struct {
+	Time                time.Time     `json:"time"`
+	ExpectedIntervalSec float64       `json:"expected_interval_sec"`
+	ActiveSources       int           `json:"active_sources"`
+	Sources             []ProbeSource `json:"sources"`
+}
+
+type ProbeTrackerOpts struct {
+	Event            *event.EventHandler
+	ExpectedInterval time.Duration
+	SummaryInterval  time.Duration
+}
+
+func NewProbeTracker(op *ProbeTrackerOpts) *ProbeTracker {
+	return &ProbeTracker{
+		sources:          make(map[string]*ProbeSource),
+		expectedInterval: op.ExpectedInterval,
+		summaryInterval:  op.SummaryInterval,
+		event:            op.Event,
+	}
+}
+
+// Observe register one probe received from the remote address.
+func (pt *ProbeTracker) Observe(remoteAddr string) {
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		ip = remoteAddr
+	}
+	now := time.Now()
+
+	pt.locker.Lock()
+	defer pt.locker.Unlock()
+
+	src, ok := pt.sources[ip]
+	if !ok {
+		pt.sources[ip] = &ProbeSource{
+			SourceIP:  ip,
+			Count:     1,
+			FirstSeen: now,
+			LastSeen:  now,
+		}
+		return
+	}
+
+	interval := now.Sub(src.LastSeen).Seconds()
+	src.Count += 1
+	src.LastSeen = now
+	src.LastIntervalSec = interval
+
+	// Count-1 intervals were observed, update the running
+	// mean and deviation of the intervals.
+	n := float64(src.Count - 1)
+	if n == 1 || interval < src.MinIntervalSec {
+		src.MinIntervalSec = interval
+	}
+	if interval > src.MaxIntervalSec {
+		src.MaxIntervalSec = interval
+	}
+	delta := interval - src.AvgIntervalSec
+	src.AvgIntervalSec += delta / n
+	src.m2 += delta * (interval - src.AvgIntervalSec)
+	if n > 1 {
+		src.JitterSec = math.Sqrt(src.m2 / (n - 1))
+	}
+	if pt.expectedInterval > 0 {
+		src.DriftSec = src.AvgIntervalSec - pt.expectedInterval.Seconds()
+	}
+}
+
+// activeWindow is the amount of time without probes that
+// a prober is still considered active.
+func (pt *ProbeTracker) activeWindow() time.Duration {
+	if pt.expectedInterval > 0 {
+		return 3 * pt.expectedInterval
+	}
+	return 90 * time.Second
+}
+
+// Summary returns the probers seen in the active window,
+// sorted by source IP.
+func (pt *ProbeTracker) Summary() *ProbeSummary {
+	now := time.Now()
+	sum := ProbeSummary{
+		Time:                now,
+		ExpectedIntervalSec: pt.expectedInterval.Seconds(),
+		Sources:             []ProbeSource{},
+	}
+
+	pt.locker.Lock()
+	for _, src := range pt.sources {
+		if now.Sub(src.LastSeen) > pt.activeWindow() {
+			continue
+		}
+		sum.Sources = append(sum.Sources, *src)
+	}
+	pt.locker.Unlock()
+
+	sort.Slice(sum.Sources, func(i, j int) bool {
+		return sum.Sources[i].SourceIP < sum.Sources[j].SourceIP
+	})
+	sum.ActiveSources = len(sum.Sources)
+	return &sum
+}
+
+// StartSummary publishes the summary of active probers
+// every summary interval.
+func (pt *ProbeTracker) StartSummary() {
+	if pt.summaryInterval <= 0 {
+		return
+	}
+	for {
+		time.Sleep(pt.summaryInterval)
+		data, err := json.Marshal(pt.Summary())
+		if err != nil {
+			continue
+		}
+		pt.event.Send("probes", "probe-tracker", string(data))
+	}
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"time"
+
 	"github.com/mtulio/go-lab-api/internal/event"
 	"github.com/mtulio/go-lab-api/internal/metric"
 )
@@ -30,11 +32,28 @@ type ServerConfig struct {
 	event    *event.EventHandler
 	metric   *metric.MetricsHandler
 	hc       *HealthCheckController
+	probes   *ProbeTracker
 	hcServer bool
 	hcPath   string
+	hcMode   TCPUnhealthyMode
+	tcpMode  TCPMode
 	certPem  string
 	certKey  string
 	debug    bool
+	connOpts *connOptions
+	instance string
+}
+
+// connOptions are the options of the connections accepted by
+// the servers.
+type connOptions struct {
+	// TCP keepalive period of the TCP servers, negative is
+	// disabled and zero is the Go default.
+	keepAlive time.Duration
+
+	// Close connections without activity after this timeout,
+	// zero is disabled.
+	idleTimeout time.Duration
 }
 
 func GetProtocolFromStr(proto string) Protocol {
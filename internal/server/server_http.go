@@ -1,14 +1,19 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+
+	"github.com/mtulio/go-lab-api/internal/header"
 )
 
 type ServerHTTP struct {
 	listener *http.ServeMux
+	conns    *connTracker
 	config   *ServerConfig
 }
 
@@ -17,6 +22,7 @@ func NewHTTPServer(cfg *ServerConfig) (*ServerHTTP, error) {
 
 	srv := ServerHTTP{
 		config: cfg,
+		conns:  newConnTracker(cfg),
 	}
 
 	srv.listener = http.NewServeMux()
@@ -49,7 +55,7 @@ func NewHTTPServer(cfg *ServerConfig) (*ServerHTTP, error) {
 	})
 
 	srv.listener.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		respBody := fmt.Sprintf("Available routes: \n/ping\n/%s", cfg.hcPath)
+		respBody := fmt.Sprintf("Available routes: \n/ping\n/probes\n/%s", cfg.hcPath)
 		w.Header().Set("Content-Type", "text/plain")
 
 		go func() {
@@ -65,6 +71,19 @@ func NewHTTPServer(cfg *ServerConfig) (*ServerHTTP, error) {
 		w.Write([]byte(respBody))
 	})
 
+	// Report the health check probers observed by the Health check server
+	if cfg.probes != nil {
+		srv.listener.HandleFunc("/probes", func(w http.ResponseWriter, r *http.Request) {
+			data, err := json.Marshal(srv.config.probes.Summary())
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(data)
+		})
+	}
+
 	// register Health-checkk endpoint only in Health check server
 
 	if cfg.hcServer {
@@ -72,6 +91,9 @@ func NewHTTPServer(cfg *ServerConfig) (*ServerHTTP, error) {
 			log.Fatal("Health-check path was not properly defined for Health Check server")
 		}
 		srv.listener.HandleFunc(cfg.hcPath, func(w http.ResponseWriter, r *http.Request) {
+			if srv.config.probes != nil {
+				srv.config.probes.Observe(r.RemoteAddr)
+			}
 			code := 200
 			respBody := srv.config.hc.GetHealthyStr()
 			w.Header().Set("Content-Type", "text/plain")
@@ -111,14 +133,37 @@ func (srv *ServerHTTP) Start() {
 	msg := fmt.Sprintf("Creating %s server on port %d\n", protoName, srv.config.port)
 	srv.config.event.Send("runtime", srv.config.name, msg)
 
+	// the keepalive option is of the TCP servers, the HTTP servers
+	// keep the net/http default.
+	lnConfig := &net.ListenConfig{}
 	port := fmt.Sprintf(":%d", srv.config.port)
+	ln, err := lnConfig.Listen(context.Background(), "tcp", port)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ln = srv.conns.Listener(ln)
+
+	// idle connections are closed by the connection tracker
+	httpSrv := &http.Server{
+		Handler: srv.withInstanceID(srv.listener),
+	}
 	if srv.config.proto == ProtoHTTPS {
-		log.Fatal(http.ListenAndServeTLS(
-			port, srv.config.certPem,
-			srv.config.certKey, srv.listener),
+		log.Fatal(httpSrv.ServeTLS(
+			ln, srv.config.certPem,
+			srv.config.certKey),
 		)
 	}
-	log.Fatal(http.ListenAndServe(port, srv.listener))
+	log.Fatal(httpSrv.Serve(ln))
+}
+
+// withInstanceID identifies the instance on every response.
+func (srv *ServerHTTP) withInstanceID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if srv.config.instance != "" {
+			w.Header().Set(header.InstanceID, srv.config.instance)
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 // StartController will do nothing in HTTP/S servers (only TCP).
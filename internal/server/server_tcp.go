@@ -1,25 +1,62 @@
 package server
 
 import (
-	"bufio"
 	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"strings"
+	"sync"
 	"syscall"
-	"time"
 
 	"golang.org/x/sys/unix"
 )
 
+// TCPUnhealthyMode is the behavior of the TCP health check
+// server when the health check is failing.
+type TCPUnhealthyMode string
+
+const (
+	// Close the listener, new connections are refused.
+	UnhealthyModeClose TCPUnhealthyMode = "close"
+	// Accept new connections and reset it (RST).
+	UnhealthyModeReset TCPUnhealthyMode = "reset"
+	// Accept new connections and never answer it.
+	UnhealthyModeHang TCPUnhealthyMode = "hang"
+)
+
+// GetTCPUnhealthyModeFromStr returns the unhealthy mode, the
+// default is to close the listener.
+func GetTCPUnhealthyModeFromStr(mode string) TCPUnhealthyMode {
+	switch mode {
+	case "reset":
+		return UnhealthyModeReset
+	case "hang":
+		return UnhealthyModeHang
+	}
+	return UnhealthyModeClose
+}
+
+type listenerState uint8
+
+const (
+	listenerStopped listenerState = iota
+	listenerStarting
+	listenerListening
+)
+
 type ServerTCP struct {
 	listener net.Listener
 	lnConfig *net.ListenConfig
+	lnState  listenerState
+	conns    *connTracker
 	config   *ServerConfig
 	quit     chan interface{}
+	locker   sync.Mutex
+
+	// stop requested while the listener is starting
+	stopPending bool
 }
 
 func NewTCPServer(cfg *ServerConfig) (*ServerTCP, error) {
@@ -27,6 +64,7 @@ func NewTCPServer(cfg *ServerConfig) (*ServerTCP, error) {
 
 	srv := ServerTCP{
 		config: cfg,
+		conns:  newConnTracker(cfg),
 	}
 
 	srv.config.event.Send(
@@ -38,16 +76,40 @@ func NewTCPServer(cfg *ServerConfig) (*ServerTCP, error) {
 // Start is responsible to setup the TCP server, listen,
 // and accept new connections routing the connections to
 // the handler with non-blocking allowing parallel connections.
+// It does nothing when the server is already listening, a pending
+// stop of the starting listener is canceled.
+//
+// The service server keeps serving while the health check is failing,
+// so the traffic of the draining target is still answered. Only the
+// health check server reacts to the health check state.
 func (srv *ServerTCP) Start() {
+	srv.locker.Lock()
+	if srv.lnState != listenerStopped {
+		srv.stopPending = false
+		srv.locker.Unlock()
+		return
+	}
+	srv.lnState = listenerStarting
+	srv.locker.Unlock()
+
 	protoName := "TCP"
+	if srv.config.proto == ProtoTLS {
+		protoName = "TLS"
+	}
+	srv.sendEvent(fmt.Sprintf("Creating %s server on port %d\n", protoName, srv.config.port))
+
 	srv.lnConfig = &net.ListenConfig{
 		Control:   TCPControl,
-		KeepAlive: -1,
+		KeepAlive: srv.config.connOpts.keepAlive,
 	}
-	if srv.config.proto == ProtoTLS {
-		protoName = "TLS"
-		srv.sendEvent(fmt.Sprintf("Creating %s server on port %d\n", protoName, srv.config.port))
+	portStr := fmt.Sprintf(":%d", srv.config.port)
+	ln, err := srv.lnConfig.Listen(context.Background(), "tcp", portStr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ln = srv.conns.Listener(ln)
 
+	if srv.config.proto == ProtoTLS {
 		cer, err := tls.LoadX509KeyPair(
 			srv.config.certPem, srv.config.certKey,
 		)
@@ -58,34 +120,21 @@ func (srv *ServerTCP) Start() {
 		tlsConfig := &tls.Config{
 			Certificates: []tls.Certificate{cer},
 		}
-		portStr := fmt.Sprintf(":%d", srv.config.port)
-
-		ln, err := tls.Listen("tcp", portStr, tlsConfig)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer ln.Close()
-		srv.listener = ln
-
-	} else {
-		srv.sendEvent(fmt.Sprintf("Creating %s server on port %d\n", protoName, srv.config.port))
-
-		portStr := fmt.Sprintf(":%d", srv.config.port)
-		ln, err := srv.lnConfig.Listen(context.Background(), "tcp", portStr)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer ln.Close()
-		srv.listener = ln
+		ln = tls.NewListener(ln, tlsConfig)
 	}
 
 	srv.sendEvent(fmt.Sprintf("Starting %s server on port %d\n", protoName, srv.config.port))
-	srv.quit = make(chan interface{})
+	quit, ok := srv.setListener(ln)
+	defer ln.Close()
+	if !ok {
+		srv.sendEvent("TCP Server stopped while starting: closing TCP Listener\n")
+		return
+	}
 	for {
-		conn, err := srv.listener.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
 			select {
-			case <-srv.quit:
+			case <-quit:
 				srv.sendEvent("TCP Server detected Unhealthy state: stopping TCP Listener\n")
 				return
 			default:
@@ -94,8 +143,14 @@ func (srv *ServerTCP) Start() {
 			continue
 		}
 
+		// Each connection on Health check server is a probe
+		if srv.config.hcServer && srv.config.probes != nil {
+			srv.config.probes.Observe(conn.RemoteAddr().String())
+		}
+
 		// Avoid to call connection handler when HC start to fail
-		if !srv.config.hc.GetHealthy() {
+		if srv.config.hcServer && !srv.config.hc.GetHealthy() {
+			go srv.unhealthyHandler(conn)
 			continue
 		}
 		go func() {
@@ -107,108 +162,109 @@ func (srv *ServerTCP) Start() {
 	}
 }
 
+// setListener register the listener that is accepting connections,
+// returning the channel closed when the listener is stopped. It
+// returns false when the server was stopped while starting.
+func (srv *ServerTCP) setListener(ln net.Listener) (chan interface{}, bool) {
+	srv.locker.Lock()
+	defer srv.locker.Unlock()
+	if srv.stopPending {
+		srv.stopPending = false
+		srv.lnState = listenerStopped
+		return nil, false
+	}
+	srv.listener = ln
+	srv.lnState = listenerListening
+	srv.quit = make(chan interface{})
+	return srv.quit, true
+}
+
+// Stop closes the listener, the accept loop will be finished. The
+// starting listener is closed when the start is finished.
 func (srv *ServerTCP) Stop() {
+	srv.locker.Lock()
+	defer srv.locker.Unlock()
+	if srv.lnState == listenerStarting {
+		srv.stopPending = true
+		return
+	}
+	if srv.lnState != listenerListening {
+		return
+	}
+	close(srv.quit)
 	srv.listener.Close()
+	srv.listener = nil
+	srv.lnState = listenerStopped
 }
 
-func (srv *ServerTCP) connHandler(conn net.Conn) {
-	defer conn.Close()
-	for {
-		netMsg, err := bufio.NewReader(conn).ReadString('\n')
-		if err != nil {
-			// log.Printf("Error ReadString: [%v]", err)
-			switch err {
-			case io.EOF:
-				return
-			default:
-				log.Printf("Error ReadString: [%v]", err)
-			}
-			return
-		}
-
-		srv.config.event.Send("request", srv.config.name, netMsg)
-		if srv.config.hcServer {
-			srv.config.metric.Inc("requests_hc")
-		} else {
-			srv.config.metric.Inc("requests_service")
-		}
-
-		cmd := strings.TrimSpace(string(netMsg))
-		if cmd == "STOP" {
-			break
-		}
+// IsListening returns true when the server is accepting connections.
+func (srv *ServerTCP) IsListening() bool {
+	srv.locker.Lock()
+	defer srv.locker.Unlock()
+	return srv.lnState != listenerStopped
+}
 
-		n, err := conn.Write([]byte(string(srv.config.hc.GetHealthyStr())))
-		if err != nil {
-			log.Println("Error writing response: ", n, err)
+// unhealthyHandler handles connections accepted while the health
+// check is failing, according the unhealthy mode.
+func (srv *ServerTCP) unhealthyHandler(conn net.Conn) {
+	if srv.config.debug {
+		msg := fmt.Sprintf("TCP Connection from %v accepted on unhealthy state, mode: %s", conn.RemoteAddr(), srv.config.hcMode)
+		srv.sendEvent(msg)
+	}
+	switch srv.config.hcMode {
+	case UnhealthyModeHang:
+		// hold the connection without answering until
+		// the client gives up.
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	default:
+		// discard any data and send RST to the client
+		raw := conn
+		for {
+			wrapped, ok := raw.(interface{ NetConn() net.Conn })
+			if !ok {
+				break
+			}
+			raw = wrapped.NetConn()
 		}
-		if srv.config.debug {
-			log.Printf("received from %v: [%s]", conn.RemoteAddr(), cmd)
+		if tcpConn, ok := raw.(*net.TCPConn); ok {
+			tcpConn.SetLinger(0)
 		}
+		conn.Close()
 	}
 }
 
-// StartController is a infinity loop to watch the Health Check
-// Controller and force the server to not answer TCP requests when
-// the health check should be in failing state.
+// StartController watches the Health Check Controller state changes
+// and force the server to not answer TCP requests when the health
+// check should be in failing state. On close mode the listener is
+// closed, otherwise the connections are handled by the unhealthy mode.
 func (srv *ServerTCP) StartController() {
-	waitReconcile := time.Duration(1 * time.Second)
-	waitStateTransiction := time.Duration(5 * time.Second)
+	// Use the controller only in health check servers
+	if !(srv.config.hcServer) {
+		fmt.Println("Ignoring Server Controller, it is enabled only in Health check servers.")
+		return
+	}
 
-	srv.sendEvent("TCP Server controller: starting in 5 seconds.")
-	srv.ControllerWaiter(waitStateTransiction)
-	for {
-		// Use the controller only in health check servers
-		if !(srv.config.hcServer) {
-			fmt.Println("Ignoring Server Controller, it is enabled only in Health check servers.")
-			return
-		}
+	msg := fmt.Sprintf("TCP Server controller: starting with unhealthy mode: %s", srv.config.hcMode)
+	srv.sendEvent(msg)
+	for change := range srv.config.hc.Subscribe() {
+		listen := change.To.Healthy() || srv.config.hcMode != UnhealthyModeClose
 
 		// State> health check is failing and server is up.
 		// Action: Server needs to be stopped
-		if !(srv.config.hc.GetHealthy()) && (srv.ServerPortIsOpen()) {
+		if !listen && srv.IsListening() {
 			srv.sendEvent("TCP Server controller: unhealthy state detected, closing the TCP listener and waiting for transiction...")
-			close(srv.quit)
 			srv.Stop()
-			srv.ControllerWaiter(waitStateTransiction)
 			continue
 		}
 
 		// State> health check has cleaned and server is down.
 		// Action: Server needs to be started
-		if (srv.config.hc.GetHealthy()) && !(srv.ServerPortIsOpen()) {
+		if listen && !srv.IsListening() {
 			srv.sendEvent("TCP Server controller: healthy state detected, starting TCP listener server...")
 			go srv.Start()
-			srv.ControllerWaiter(waitStateTransiction)
-			continue
 		}
-
-		// State> Health check failing and server is down.
-		// Action: register the event and wait to to reconcile period
-		if !(srv.config.hc.GetHealthy()) && !(srv.ServerPortIsOpen()) {
-			srv.sendEvent("TCP Server controller: health check is failing and server is stopped, waiting to state change")
-		}
-
-		// Last state> Health check and server listening successfully.
-		// Action: wait to to reconcile period.
-		srv.ControllerWaiter(waitReconcile)
-	}
-}
-
-// ControllerWaiter wait in seconds
-func (srv *ServerTCP) ControllerWaiter(t time.Duration) {
-	time.Sleep(t)
-}
-
-// ServerPortIsOpen checks whether the TCP port is Opened, and return
-// a boolean. True when the TCP Port is opened.
-func (srv *ServerTCP) ServerPortIsOpen() bool {
-	isOpen := true
-	_, err := net.Dial("tcp", fmt.Sprintf(":%d", srv.config.port))
-	if err != nil {
-		isOpen = false
 	}
-	return isOpen
 }
 
 // TCPControl set of flags of TCP listener to reuse the
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TCPMode is the protocol served on TCP/TLS connections.
+type TCPMode string
+
+const (
+	// Line command protocol: PING, HEALTH, ECHO, SLEEP, CLOSE, STATS.
+	TCPModeCommand TCPMode = "command"
+	// Echo back every byte received.
+	TCPModeEcho TCPMode = "echo"
+	// Discard every byte received, never answer.
+	TCPModeDiscard TCPMode = "discard"
+	// Stream a character generator pattern (RFC 864).
+	TCPModeChargen TCPMode = "chargen"
+)
+
+// GetTCPModeFromStr returns the TCP mode, the default is the
+// command protocol.
+func GetTCPModeFromStr(mode string) TCPMode {
+	switch mode {
+	case "echo":
+		return TCPModeEcho
+	case "discard":
+		return TCPModeDiscard
+	case "chargen":
+		return TCPModeChargen
+	}
+	return TCPModeCommand
+}
+
+// connStats is the statistics of one connection returned by STATS.
+type connStats struct {
+	Server     string `json:"server"`
+	RemoteAddr string `json:"remote_addr"`
+	UptimeMs   int64  `json:"uptime_ms"`
+	Commands   uint64 `json:"commands"`
+	Health     string `json:"health"`
+}
+
+// connHandler routes the connection to the handler of the TCP mode.
+// Health check servers always serve the command protocol.
+func (srv *ServerTCP) connHandler(conn net.Conn) {
+	defer conn.Close()
+
+	mode := srv.config.tcpMode
+	if srv.config.hcServer {
+		mode = TCPModeCommand
+	}
+	if mode != TCPModeCommand {
+		srv.incRequests()
+	}
+
+	switch mode {
+	case TCPModeEcho:
+		io.Copy(conn, conn)
+	case TCPModeDiscard:
+		io.Copy(io.Discard, conn)
+	case TCPModeChargen:
+		srv.chargenHandler(conn)
+	default:
+		srv.commandHandler(conn)
+	}
+}
+
+// commandHandler serves the line command protocol, each command
+// is answered with a newline-terminated response.
+func (srv *ServerTCP) commandHandler(conn net.Conn) {
+	start := time.Now()
+	reader := bufio.NewReader(conn)
+	var commands uint64 = 0
+	for {
+		netMsg, err := reader.ReadString('\n')
+		if err != nil {
+			switch err {
+			case io.EOF:
+				return
+			default:
+				log.Printf("Error ReadString: [%v]", err)
+			}
+			return
+		}
+
+		srv.config.event.Send("request", srv.config.name, netMsg)
+		srv.incRequests()
+		commands += 1
+
+		line := strings.TrimSpace(string(netMsg))
+		if srv.config.debug {
+			log.Printf("received from %v: [%s]", conn.RemoteAddr(), line)
+		}
+		cmd, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			cmd, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+
+		closeConn := false
+		var resp string
+		switch strings.ToUpper(cmd) {
+		case "PING":
+			resp = "PONG"
+		case "HEALTH":
+			resp = srv.config.hc.GetHealthyStr()
+		case "ECHO":
+			resp = arg
+		case "SLEEP":
+			ms, err := strconv.ParseUint(arg, 10, 32)
+			if err != nil {
+				resp = fmt.Sprintf("ERR invalid sleep time: %s", arg)
+				break
+			}
+			time.Sleep(time.Duration(ms) * time.Millisecond)
+			resp = "OK"
+		case "STATS":
+			data, _ := json.Marshal(&connStats{
+				Server:     srv.config.name,
+				RemoteAddr: conn.RemoteAddr().String(),
+				UptimeMs:   time.Since(start).Milliseconds(),
+				Commands:   commands,
+				Health:     srv.config.hc.GetHealthyStr(),
+			})
+			resp = string(data)
+		case "CLOSE", "STOP":
+			resp = "BYE"
+			closeConn = true
+		case "":
+			resp = "ERR empty command"
+		default:
+			resp = fmt.Sprintf("ERR unknown command: %s", cmd)
+		}
+
+		n, err := conn.Write([]byte(resp + "\n"))
+		if err != nil {
+			log.Println("Error writing response: ", n, err)
+			return
+		}
+		if closeConn {
+			return
+		}
+	}
+}
+
+// chargenHandler streams the RFC 864 pattern: lines of 72
+// printable characters, rotating the first character by line.
+func (srv *ServerTCP) chargenHandler(conn net.Conn) {
+	const lineLen = 72
+	printable := make([]byte, 95)
+	for i := range printable {
+		printable[i] = byte(' ' + i)
+	}
+
+	// Reads are discarded, the stream ends when the client closes.
+	go io.Copy(io.Discard, conn)
+
+	line := make([]byte, lineLen+2)
+	for offset := 0; ; offset = (offset + 1) % len(printable) {
+		for i := 0; i < lineLen; i++ {
+			line[i] = printable[(offset+i)%len(printable)]
+		}
+		line[lineLen], line[lineLen+1] = '\r', '\n'
+		if _, err := conn.Write(line); err != nil {
+			return
+		}
+	}
+}
+
+func (srv *ServerTCP) incRequests() {
+	if srv.config.hcServer {
+		srv.config.metric.Inc("requests_hc")
+	} else {
+		srv.config.metric.Inc("requests_service")
+	}
+}
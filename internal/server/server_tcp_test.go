@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestStopWhileStarting(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	srv := ServerTCP{lnState: listenerStarting}
+
+	// the stop is applied when the start is finished
+	srv.Stop()
+	if _, ok := srv.setListener(ln); ok {
+		t.Fatal("listener started after the pending stop")
+	}
+	if srv.IsListening() {
+		t.Fatal("server is listening after the pending stop")
+	}
+
+	// a new start cancels the pending stop
+	srv.lnState = listenerStarting
+	srv.Stop()
+	srv.Start()
+	if _, ok := srv.setListener(ln); !ok {
+		t.Fatal("listener stopped after the start canceled the pending stop")
+	}
+	srv.Stop()
+	if srv.IsListening() {
+		t.Fatal("server is listening after the stop")
+	}
+}
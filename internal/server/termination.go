@@ -0,0 +1,197 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mtulio/go-lab-api/internal/event"
+	"github.com/mtulio/go-lab-api/internal/metric"
+)
+
+// TerminationTracker follows the termination of an external process,
+// eg: kube-apiserver. The termination starts when the signal is
+// received, the process is draining when the health check starts
+// to fail, and the termination is finished when the health check
+// passes again. The states are the same of the Health Check
+// Controller, so the subscribers can consume both.
+//
+// A failure shorter than the probe interval is not observed, the
+// termination is finished by the first healthy probe after the
+// terminating timeout.
+type TerminationTracker struct {
+	state HCState
+
+	// Signals which start the termination
+	signals []os.Signal
+
+	terminationStartTime time.Time
+	drainStartTime       time.Time
+
+	// time to wait the health check to fail after the signal
+	terminatingTimeout time.Duration
+
+	subscribers []chan HCStateChange
+
+	// mutex
+	locker sync.Mutex
+
+	Event *event.EventHandler
+
+	Metric *metric.MetricsHandler
+}
+
+type TerminationTrackerOpts struct {
+	Event   *event.EventHandler
+	Metric  *metric.MetricsHandler
+	Signals []os.Signal
+
+	// TerminatingTimeout is the time to wait the health check to fail
+	// after the signal, default is 2 minutes.
+	TerminatingTimeout time.Duration
+}
+
+// defaultTerminatingTimeout is the default time to wait the health
+// check to fail after the termination signal.
+const defaultTerminatingTimeout = 2 * time.Minute
+
+func NewTerminationTracker(op *TerminationTrackerOpts) *TerminationTracker {
+	tt := TerminationTracker{
+		state:   StateUnhealthy,
+		signals: op.Signals,
+		Event:   op.Event,
+		Metric:  op.Metric,
+
+		terminatingTimeout: op.TerminatingTimeout,
+	}
+	if len(tt.signals) == 0 {
+		tt.signals = []os.Signal{syscall.SIGTERM}
+	}
+	if tt.terminatingTimeout == 0 {
+		tt.terminatingTimeout = defaultTerminatingTimeout
+	}
+	tt.Metric.SetAppState(tt.state.Healthy(), tt.state.Terminating())
+	return &tt
+}
+
+// Start handles the termination signals.
+func (tt *TerminationTracker) Start() {
+	tt.Event.Send("runtime", "termination-tracker", "Running Signal handler")
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, tt.signals...)
+	for sig := range sigs {
+		msg := fmt.Sprintf("Termination signal received: %s", sig)
+		tt.Event.Send("runtime", "termination-tracker", msg)
+		if err := tt.StartTermination(); err != nil {
+			msg = fmt.Sprintf("Termination signal %s ignored: %v", sig, err)
+			tt.Event.Send("runtime", "termination-tracker", msg)
+		}
+	}
+}
+
+// Subscribe returns a channel notified on every state change. The
+// current state is sent first, so the subscriber can sync up.
+func (tt *TerminationTracker) Subscribe() <-chan HCStateChange {
+	ch := make(chan HCStateChange, 16)
+
+	tt.locker.Lock()
+	defer tt.locker.Unlock()
+	ch <- HCStateChange{
+		From:   tt.state,
+		To:     tt.state,
+		Time:   time.Now(),
+		Reason: "subscribed",
+	}
+	tt.subscribers = append(tt.subscribers, ch)
+	return ch
+}
+
+// GetState returns the current state of the tracker.
+func (tt *TerminationTracker) GetState() HCState {
+	tt.locker.Lock()
+	defer tt.locker.Unlock()
+	return tt.state
+}
+
+// StartTermination registers the termination start, the process
+// is still healthy until the health check fails.
+func (tt *TerminationTracker) StartTermination() error {
+	tt.locker.Lock()
+	if tt.state.Terminating() {
+		tt.locker.Unlock()
+		return errTerminationInProgress
+	}
+	to := StateTerminating
+	if !tt.state.Healthy() {
+		to = StateDraining
+	}
+	tt.terminationStartTime = time.Now()
+	tt.drainStartTime = tt.terminationStartTime
+	change := tt.setState(to, "termination started")
+	tt.locker.Unlock()
+
+	tt.sendChange(change)
+	return nil
+}
+
+// Observe registers the health check result of the process.
+func (tt *TerminationTracker) Observe(healthy bool) {
+	tt.locker.Lock()
+	var change *HCStateChange
+	switch {
+	case healthy && tt.state == StateDraining:
+		reason := fmt.Sprintf("termination finished in %.3fs, draining for %.3fs",
+			time.Since(tt.terminationStartTime).Seconds(),
+			time.Since(tt.drainStartTime).Seconds())
+		change = tt.setState(StateHealthy, reason)
+	case healthy && tt.state == StateUnhealthy:
+		change = tt.setState(StateHealthy, "health check passed")
+	case healthy && tt.state == StateTerminating &&
+		time.Since(tt.terminationStartTime) >= tt.terminatingTimeout:
+		reason := fmt.Sprintf("termination finished in %.3fs, no health check failure observed",
+			time.Since(tt.terminationStartTime).Seconds())
+		change = tt.setState(StateHealthy, reason)
+	case !healthy && tt.state == StateTerminating:
+		tt.drainStartTime = time.Now()
+		reason := fmt.Sprintf("health check failed after %.3fs of termination",
+			tt.drainStartTime.Sub(tt.terminationStartTime).Seconds())
+		change = tt.setState(StateDraining, reason)
+	case !healthy && tt.state == StateHealthy:
+		change = tt.setState(StateUnhealthy, "health check failed")
+	}
+	tt.locker.Unlock()
+
+	tt.sendChange(change)
+}
+
+// setState runs the transition to the state, updating the
+// metrics. Must be called with lock held.
+func (tt *TerminationTracker) setState(to HCState, reason string) *HCStateChange {
+	from := tt.state
+	if from == to || !from.canTransitionTo(to) {
+		return nil
+	}
+	tt.state = to
+	tt.Metric.SetAppState(to.Healthy(), to.Terminating())
+
+	change := HCStateChange{
+		From:   from,
+		To:     to,
+		Time:   time.Now(),
+		Reason: reason,
+	}
+	NotifySubscribers(tt.subscribers, change)
+	return &change
+}
+
+func (tt *TerminationTracker) sendChange(change *HCStateChange) {
+	if change == nil {
+		return
+	}
+	msg := fmt.Sprintf("State changed from %s to %s: %s", change.From, change.To, change.Reason)
+	tt.Event.Send("runtime", "termination-tracker", msg)
+}
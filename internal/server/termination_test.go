@@ -0,0 +1,111 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mtulio/go-lab-api/internal/event"
+	"github.com/mtulio/go-lab-api/internal/metric"
+)
+
+func newTestTracker(t *testing.T) *TerminationTracker {
+	ev := event.NewEventHandler("test", filepath.Join(t.TempDir(), "events.log"))
+	return NewTerminationTracker(&TerminationTrackerOpts{
+		Event:  ev,
+		Metric: metric.NewMetricHandler(nil),
+	})
+}
+
+func TestTrackerTermination(t *testing.T) {
+	tt := newTestTracker(t)
+	changes := tt.Subscribe()
+	tests := []struct {
+		name     string
+		fn       func()
+		expected HCState
+	}{
+		{"healthy", func() { tt.Observe(true) }, StateHealthy},
+		{"signal", func() { tt.StartTermination() }, StateTerminating},
+		{"healthy while terminating", func() { tt.Observe(true) }, StateTerminating},
+		{"failing", func() { tt.Observe(false) }, StateDraining},
+		{"failing while draining", func() { tt.Observe(false) }, StateDraining},
+		{"healthy again", func() { tt.Observe(true) }, StateHealthy},
+	}
+	for _, tc := range tests {
+		tc.fn()
+		if got := tt.GetState(); got != tc.expected {
+			t.Errorf("%s: state is %s, expected %s", tc.name, got, tc.expected)
+		}
+	}
+	expected := []HCState{StateUnhealthy, StateHealthy, StateTerminating, StateDraining, StateHealthy}
+	for i, state := range expected {
+		if change := <-changes; change.To != state {
+			t.Errorf("change %d is to %s, expected %s", i, change.To, state)
+		}
+	}
+	if len(changes) > 0 {
+		change := <-changes
+		t.Errorf("unexpected change from %s to %s: %s", change.From, change.To, change.Reason)
+	}
+}
+
+func TestTrackerTerminationUnhealthy(t *testing.T) {
+	tt := newTestTracker(t)
+	if err := tt.StartTermination(); err != nil {
+		t.Fatal(err)
+	}
+	// the process is already failing, it is draining
+	if tt.GetState() != StateDraining {
+		t.Fatalf("state is %s, expected %s", tt.GetState(), StateDraining)
+	}
+	tt.Observe(true)
+	if tt.GetState() != StateHealthy {
+		t.Errorf("state is %s, expected %s", tt.GetState(), StateHealthy)
+	}
+}
+
+func TestTrackerSecondTermination(t *testing.T) {
+	tt := newTestTracker(t)
+	tt.Observe(true)
+	if err := tt.StartTermination(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tt.StartTermination(); err != errTerminationInProgress {
+		t.Errorf("second termination returned %v, expected %v", err, errTerminationInProgress)
+	}
+	tt.Observe(false)
+	if err := tt.StartTermination(); err != errTerminationInProgress {
+		t.Errorf("termination while draining returned %v, expected %v", err, errTerminationInProgress)
+	}
+
+	// a new termination after the previous one finished
+	tt.Observe(true)
+	if err := tt.StartTermination(); err != nil || tt.GetState() != StateTerminating {
+		t.Errorf("new termination returned %v, state is %s", err, tt.GetState())
+	}
+}
+
+func TestTrackerTerminatingTimeout(t *testing.T) {
+	tt := newTestTracker(t)
+	tt.terminatingTimeout = 50 * time.Millisecond
+	tt.Observe(true)
+	if err := tt.StartTermination(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the failure was not observed between the probes, the first
+	// healthy probe after the timeout finishes the termination
+	tt.Observe(true)
+	if tt.GetState() != StateTerminating {
+		t.Fatalf("state is %s before the timeout, expected %s", tt.GetState(), StateTerminating)
+	}
+	time.Sleep(60 * time.Millisecond)
+	tt.Observe(true)
+	if tt.GetState() != StateHealthy {
+		t.Fatalf("state is %s after the timeout, expected %s", tt.GetState(), StateHealthy)
+	}
+	if err := tt.StartTermination(); err != nil {
+		t.Errorf("termination after the timeout returned %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package watcher
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	elbv2 "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/mtulio/go-lab-api/internal/metric"
+)
+
+// defaultRoleSessionName is the session name of the assumed role.
+const defaultRoleSessionName = "go-lab-api-watcher"
+
+// maxAttempts of each API call. The throttling and transient errors
+// are retried by the SDK, then by the watcher with backoff.
+const maxAttempts = 3
+
+// AWSOptions configures the AWS client of the watcher, the empty
+// options use the ambient configuration (environment, shared config
+// and instance profile).
+type AWSOptions struct {
+	Region  string
+	Profile string
+
+	// RoleARN is the role to assume, with the session name.
+	RoleARN         string
+	RoleSessionName string
+
+	// Endpoint is a custom ELBv2 endpoint URL, eg: a local emulator
+	// like LocalStack or moto (http://localhost:4566).
+	Endpoint string
+}
+
+// elbv2API is the ELBv2 API used by the watchers and the experiment,
+// mocked on tests.
+type elbv2API interface {
+	DescribeTargetHealth(context.Context, *elbv2.DescribeTargetHealthInput, ...func(*elbv2.Options)) (*elbv2.DescribeTargetHealthOutput, error)
+	DescribeTargetGroupAttributes(context.Context, *elbv2.DescribeTargetGroupAttributesInput, ...func(*elbv2.Options)) (*elbv2.DescribeTargetGroupAttributesOutput, error)
+	RegisterTargets(context.Context, *elbv2.RegisterTargetsInput, ...func(*elbv2.Options)) (*elbv2.RegisterTargetsOutput, error)
+	DeregisterTargets(context.Context, *elbv2.DeregisterTargetsInput, ...func(*elbv2.Options)) (*elbv2.DeregisterTargetsOutput, error)
+	elbv2.DescribeTargetGroupsAPIClient
+}
+
+// newELBV2Client returns the ELBv2 client of the options, counting
+// the API calls and retries on metrics.
+func newELBV2Client(ctx context.Context, op *AWSOptions, m *metric.MetricsHandler) (elbv2API, error) {
+	loadOpts := []func(*config.LoadOptions) error{
+		config.WithRetryer(func() aws.Retryer {
+			return retry.AddWithMaxAttempts(retry.NewStandard(), maxAttempts)
+		}),
+	}
+	if op.Region != "" {
+		loadOpts = append(loadOpts, config.WithRegion(op.Region))
+	}
+	if op.Profile != "" {
+		loadOpts = append(loadOpts, config.WithSharedConfigProfile(op.Profile))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if op.RoleARN != "" {
+		name := op.RoleSessionName
+		if name == "" {
+			name = defaultRoleSessionName
+		}
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), op.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = name
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+	if cfg.Credentials != nil {
+		cfg.Credentials = typedCredentials{cfg.Credentials}
+	}
+
+	return elbv2.NewFromConfig(cfg, func(o *elbv2.Options) {
+		if op.Endpoint != "" {
+			o.BaseEndpoint = aws.String(op.Endpoint)
+		}
+		o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+			return stack.Initialize.Add(apiMetrics(m), middleware.After)
+		})
+	}), nil
+}
+
+// apiMetrics counts the API calls, and the attempts retried by the
+// SDK, wrapping the retry middleware.
+func apiMetrics(m *metric.MetricsHandler) middleware.InitializeMiddleware {
+	return middleware.InitializeMiddlewareFunc("WatcherMetrics", func(
+		ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler,
+	) (middleware.InitializeOutput, middleware.Metadata, error) {
+		out, md, err := next.HandleInitialize(ctx, in)
+		m.Inc("tg_api_calls")
+		if results, ok := retry.GetAttemptResults(md); ok {
+			for i := 1; i < len(results.Results); i++ {
+				m.Inc("tg_api_retries")
+			}
+		}
+		return out, md, err
+	})
+}
+
+// CredentialsError is the error retrieving the credentials, which
+// the SDK returns untyped.
+type CredentialsError struct {
+	Err error
+}
+
+func (e *CredentialsError) Error() string {
+	return "retrieve credentials: " + e.Err.Error()
+}
+
+func (e *CredentialsError) Unwrap() error {
+	return e.Err
+}
+
+// typedCredentials returns the credentials errors as CredentialsError.
+type typedCredentials struct {
+	aws.CredentialsProvider
+}
+
+func (p typedCredentials) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	creds, err := p.CredentialsProvider.Retrieve(ctx)
+	if err != nil {
+		return creds, &CredentialsError{Err: err}
+	}
+	return creds, nil
+}
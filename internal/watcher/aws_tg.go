@@ -1,83 +1,99 @@
 package watcher
 
 import (
-	"fmt"
-	"time"
+	"context"
+	"strings"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/elbv2"
-	"github.com/mtulio/go-lab-api/internal/event"
-	"github.com/mtulio/go-lab-api/internal/metric"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	elbv2 "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
 )
 
-type TargetGroupWatcher struct {
-	options *TGWatcherOptions
+// awsTargetGroup describes the targets of an AWS ELBv2 target group.
+type awsTargetGroup struct {
+	name   string
+	arn    string
+	client elbv2API
+}
 
-	cliSvc   *elbv2.ELBV2
-	cliInput *elbv2.DescribeTargetHealthInput
+func NewTargetGroupWatcher(op *TGWatcherOptions) (*TargetGroupWatcher, error) {
+	client, err := newELBV2Client(watcherContext(op), &op.AWS, op.Metric)
+	if err != nil {
+		return nil, err
+	}
+	return NewWatcherWithSource(op, newAWSTargetGroup(client, op.ARN)), nil
 }
 
-type TGWatcherOptions struct {
-	ARN      string
-	Interval time.Duration
-	Metric   *metric.MetricsHandler
-	Event    *event.EventHandler
+func newAWSTargetGroup(client elbv2API, arn string) *awsTargetGroup {
+	return &awsTargetGroup{
+		name:   resourceName(arn),
+		arn:    arn,
+		client: client,
+	}
 }
 
-func NewTargetGroupWatcher(op *TGWatcherOptions) (*TargetGroupWatcher, error) {
+func (src *awsTargetGroup) Name() string {
+	return src.name
+}
 
-	tgw := TargetGroupWatcher{
-		options: op,
+// DescribeTargets describes the target health of the target group.
+func (src *awsTargetGroup) DescribeTargets(ctx context.Context) ([]*Target, error) {
+	result, err := src.client.DescribeTargetHealth(ctx, &elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(src.arn),
+	})
+	if err != nil {
+		return nil, err
 	}
-	//sess := session.Must(session.NewSession())
-	svc := elbv2.New(session.New())
-	input := &elbv2.DescribeTargetHealthInput{
-		TargetGroupArn: aws.String(op.ARN),
+	targets := []*Target{}
+	for _, d := range result.TargetHealthDescriptions {
+		t := Target{}
+		if d.Target != nil {
+			t.ID = aws.ToString(d.Target.Id)
+			t.Port = int64(aws.ToInt32(d.Target.Port))
+			t.AZ = aws.ToString(d.Target.AvailabilityZone)
+		}
+		if d.TargetHealth != nil {
+			t.State = string(d.TargetHealth.State)
+			t.Reason = string(d.TargetHealth.Reason)
+			t.Description = aws.ToString(d.TargetHealth.Description)
+		}
+		targets = append(targets, &t)
 	}
-	tgw.cliSvc = svc
-	tgw.cliInput = input
-	return &tgw, nil
+	return targets, nil
 }
 
-func (tg *TargetGroupWatcher) Start() {
-	for {
-		result, err := tg.cliSvc.DescribeTargetHealth(tg.cliInput)
+// resolveTargetGroups returns the ARNs of the target groups of the
+// load balancer.
+func resolveTargetGroups(ctx context.Context, client elbv2API, lbARN string) ([]string, error) {
+	arns := []string{}
+	pages := elbv2.NewDescribeTargetGroupsPaginator(client, &elbv2.DescribeTargetGroupsInput{
+		LoadBalancerArn: aws.String(lbARN),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
 		if err != nil {
-			if aerr, ok := err.(awserr.Error); ok {
-				switch aerr.Code() {
-				case elbv2.ErrCodeInvalidTargetException:
-					fmt.Println(elbv2.ErrCodeInvalidTargetException, aerr.Error())
-				case elbv2.ErrCodeTargetGroupNotFoundException:
-					fmt.Println(elbv2.ErrCodeTargetGroupNotFoundException, aerr.Error())
-				case elbv2.ErrCodeHealthUnavailableException:
-					fmt.Println(elbv2.ErrCodeHealthUnavailableException, aerr.Error())
-				default:
-					fmt.Println(aerr.Error())
-				}
-			} else {
-				// Print the error, cast err to awserr.Error to get the Code and
-				// Message from an error.
-				fmt.Println(err.Error())
-			}
-			return
+			return nil, err
 		}
-		// fmt.Println(result)
-		healthCount := 0
-		unhealthyCount := 0
-		for _, d := range result.TargetHealthDescriptions {
-			//fmt.Println(*d.TargetHealth.State, *d.TargetHealth.Reason)
-			if *d.TargetHealth.State == "healthy" {
-				healthCount += 1
-				continue
-			}
-			unhealthyCount += 1
+		for _, tg := range page.TargetGroups {
+			arns = append(arns, aws.ToString(tg.TargetGroupArn))
 		}
+	}
+	return arns, nil
+}
+
+// isLoadBalancerARN returns whether the ARN is of a load balancer,
+// otherwise it is of a target group.
+func isLoadBalancerARN(arn string) bool {
+	return strings.Contains(arn, ":loadbalancer/")
+}
 
-		tg.options.Metric.TargetHealthy = (unhealthyCount == 0)
-		tg.options.Metric.TargetHealthCount = uint64(healthCount)
-		tg.options.Metric.TargetUnhealthCount = uint64(unhealthyCount)
-		time.Sleep(1 * time.Second)
+// resourceName returns the name of the ELBv2 resource of the ARN.
+// Eg: arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/my-tg/73e2d6bc24d8a067
+// is my-tg.
+func resourceName(arn string) string {
+	parts := strings.Split(arn[strings.LastIndex(arn, ":")+1:], "/")
+	if len(parts) < 3 {
+		return arn
 	}
+	// load balancers are: loadbalancer/net/my-lb/50dc6c495c0c9188
+	return parts[len(parts)-2]
 }
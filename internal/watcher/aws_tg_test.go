@@ -0,0 +1,495 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	elbv2 "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	"github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+	"github.com/aws/smithy-go"
+	"github.com/mtulio/go-lab-api/internal/event"
+	"github.com/mtulio/go-lab-api/internal/metric"
+	"github.com/mtulio/go-lab-api/internal/server"
+)
+
+const testTGARN = "arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/my-tg/73e2d6bc24d8a067"
+
+// mockELBV2 returns the responses in order, the last one is repeated.
+type mockELBV2 struct {
+	health []mockHealth
+	pages  []*elbv2.DescribeTargetGroupsOutput
+	calls  int
+
+	// registered and deregistered targets
+	registered   []string
+	deregistered []string
+
+	// error and calls describing the configuration
+	configErr   error
+	configCalls int
+}
+
+type mockHealth struct {
+	targets []types.TargetHealthDescription
+	err     error
+}
+
+func (m *mockELBV2) DescribeTargetHealth(ctx context.Context, in *elbv2.DescribeTargetHealthInput, opts ...func(*elbv2.Options)) (*elbv2.DescribeTargetHealthOutput, error) {
+	if aws.ToString(in.TargetGroupArn) != testTGARN {
+		return nil, fmt.Errorf("unexpected target group %s", aws.ToString(in.TargetGroupArn))
+	}
+	resp := m.health[len(m.health)-1]
+	if m.calls < len(m.health) {
+		resp = m.health[m.calls]
+	}
+	m.calls += 1
+	if resp.err != nil {
+		return nil, resp.err
+	}
+	return &elbv2.DescribeTargetHealthOutput{TargetHealthDescriptions: resp.targets}, nil
+}
+
+// mockConfig is the configuration of the test target group.
+var mockConfig = types.TargetGroup{
+	TargetGroupArn:             aws.String(testTGARN),
+	TargetGroupName:            aws.String("my-tg"),
+	Protocol:                   types.ProtocolEnumTcp,
+	Port:                       aws.Int32(6443),
+	HealthCheckIntervalSeconds: aws.Int32(10),
+	HealthCheckTimeoutSeconds:  aws.Int32(10),
+	HealthyThresholdCount:      aws.Int32(2),
+	UnhealthyThresholdCount:    aws.Int32(2),
+}
+
+func (m *mockELBV2) DescribeTargetGroups(ctx context.Context, in *elbv2.DescribeTargetGroupsInput, opts ...func(*elbv2.Options)) (*elbv2.DescribeTargetGroupsOutput, error) {
+	// the configuration is described by ARN, not counted as a call
+	if len(in.TargetGroupArns) > 0 {
+		m.configCalls += 1
+		if m.configErr != nil {
+			return nil, m.configErr
+		}
+		return &elbv2.DescribeTargetGroupsOutput{TargetGroups: []types.TargetGroup{mockConfig}}, nil
+	}
+	page := m.pages[m.calls]
+	m.calls += 1
+	if m.calls > 1 && aws.ToString(in.Marker) != fmt.Sprintf("page-%d", m.calls-1) {
+		return nil, fmt.Errorf("unexpected marker %q", aws.ToString(in.Marker))
+	}
+	return page, nil
+}
+
+func (m *mockELBV2) DescribeTargetGroupAttributes(ctx context.Context, in *elbv2.DescribeTargetGroupAttributesInput, opts ...func(*elbv2.Options)) (*elbv2.DescribeTargetGroupAttributesOutput, error) {
+	return &elbv2.DescribeTargetGroupAttributesOutput{Attributes: []types.TargetGroupAttribute{
+		{Key: aws.String(attrDeregistrationDelay), Value: aws.String("30")},
+		{Key: aws.String(attrConnectionTermination), Value: aws.String("false")},
+	}}, nil
+}
+
+func (m *mockELBV2) RegisterTargets(ctx context.Context, in *elbv2.RegisterTargetsInput, opts ...func(*elbv2.Options)) (*elbv2.RegisterTargetsOutput, error) {
+	m.registered = append(m.registered, aws.ToString(in.Targets[0].Id))
+	return &elbv2.RegisterTargetsOutput{}, nil
+}
+
+func (m *mockELBV2) DeregisterTargets(ctx context.Context, in *elbv2.DeregisterTargetsInput, opts ...func(*elbv2.Options)) (*elbv2.DeregisterTargetsOutput, error) {
+	m.deregistered = append(m.deregistered, aws.ToString(in.Targets[0].Id))
+	return &elbv2.DeregisterTargetsOutput{}, nil
+}
+
+func target(id string, state types.TargetHealthStateEnum, reason types.TargetHealthReasonEnum) types.TargetHealthDescription {
+	return types.TargetHealthDescription{
+		Target: &types.TargetDescription{
+			Id:               aws.String(id),
+			Port:             aws.Int32(6443),
+			AvailabilityZone: aws.String("us-east-1a"),
+		},
+		TargetHealth: &types.TargetHealth{
+			State:  state,
+			Reason: reason,
+		},
+	}
+}
+
+func newTestWatcher(api elbv2API) (*TargetGroupWatcher, *metric.MetricsHandler) {
+	m := metric.NewMetricHandler(nil)
+	tgw := NewWatcherWithSource(&TGWatcherOptions{
+		Metric:    m,
+		RateLimit: -1,
+	}, newAWSTargetGroup(api, testTGARN))
+	tgw.selfIDs = []string{"10.0.0.1"}
+	return tgw, m
+}
+
+func TestDescribeTargets(t *testing.T) {
+	api := &mockELBV2{health: []mockHealth{{targets: []types.TargetHealthDescription{
+		target("10.0.0.1", types.TargetHealthStateEnumDraining, types.TargetHealthReasonEnumDeregistrationInProgress),
+		{Target: &types.TargetDescription{Id: aws.String("10.0.0.2")}},
+	}}}}
+	src := newAWSTargetGroup(api, testTGARN)
+	if src.Name() != "my-tg" {
+		t.Errorf("name is %q, expected my-tg", src.Name())
+	}
+
+	targets, err := src.DescribeTargets(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("got %d targets, expected 2", len(targets))
+	}
+	got := *targets[0]
+	expected := Target{
+		ID:     "10.0.0.1",
+		Port:   6443,
+		AZ:     "us-east-1a",
+		State:  TargetStateDraining,
+		Reason: "Target.DeregistrationInProgress",
+	}
+	if got != expected {
+		t.Errorf("got target %+v, expected %+v", got, expected)
+	}
+	if targets[1].ID != "10.0.0.2" || targets[1].State != "" {
+		t.Errorf("got target %+v without health", *targets[1])
+	}
+}
+
+func TestRefreshTransitions(t *testing.T) {
+	api := &mockELBV2{health: []mockHealth{
+		{targets: []types.TargetHealthDescription{
+			target("10.0.0.1", types.TargetHealthStateEnumHealthy, ""),
+			target("10.0.0.2", types.TargetHealthStateEnumHealthy, ""),
+		}},
+		{targets: []types.TargetHealthDescription{
+			target("10.0.0.1", types.TargetHealthStateEnumDraining, types.TargetHealthReasonEnumDeregistrationInProgress),
+			target("10.0.0.2", types.TargetHealthStateEnumHealthy, ""),
+		}},
+		{targets: []types.TargetHealthDescription{
+			target("10.0.0.2", types.TargetHealthStateEnumHealthy, ""),
+		}},
+	}}
+	tgw, m := newTestWatcher(api)
+
+	tests := []struct {
+		healthy   bool
+		healthCnt uint64
+		draining  uint64
+		self      string
+	}{
+		{healthy: true, healthCnt: 2, draining: 0, self: TargetStateHealthy},
+		{healthy: false, healthCnt: 1, draining: 1, self: TargetStateDraining},
+		{healthy: true, healthCnt: 1, draining: 0, self: TargetStateUnregistered},
+	}
+	for i, tt := range tests {
+		if err := tgw.refresh(context.Background()); err != nil {
+			t.Fatalf("refresh %d: %v", i, err)
+		}
+		if m.TargetHealthy != tt.healthy {
+			t.Errorf("refresh %d: tg_healthy is %v, expected %v", i, m.TargetHealthy, tt.healthy)
+		}
+		if m.TargetHealthCount != tt.healthCnt {
+			t.Errorf("refresh %d: tg_health_count is %d, expected %d", i, m.TargetHealthCount, tt.healthCnt)
+		}
+		if m.TargetStates[TargetStateDraining] != tt.draining {
+			t.Errorf("refresh %d: draining targets are %d, expected %d", i, m.TargetStates[TargetStateDraining], tt.draining)
+		}
+		if m.SelfTargetState != tt.self {
+			t.Errorf("refresh %d: self_target_state is %q, expected %q", i, m.SelfTargetState, tt.self)
+		}
+		if m.TargetGroups["my-tg"].SelfState != tt.self {
+			t.Errorf("refresh %d: my-tg self state is %q, expected %q", i, m.TargetGroups["my-tg"].SelfState, tt.self)
+		}
+	}
+
+	// the removed target is not tracked anymore
+	if _, ok := tgw.targets["10.0.0.1:6443"]; ok {
+		t.Errorf("removed target is still tracked")
+	}
+}
+
+func TestFindSelf(t *testing.T) {
+	tgw, _ := newTestWatcher(&mockELBV2{})
+	targets := []*Target{
+		{ID: "10.0.0.2", Port: 6443},
+		{ID: "10.0.0.1", Port: 22623},
+		{ID: "10.0.0.1", Port: 6443},
+	}
+	tests := []struct {
+		port     int64
+		expected *Target
+	}{
+		{0, targets[1]},
+		{6443, targets[2]},
+		{443, nil},
+	}
+	for _, tt := range tests {
+		tgw.options.SelfPort = tt.port
+		if got := tgw.findSelf(targets); got != tt.expected {
+			t.Errorf("self port %d: got target %+v, expected %+v", tt.port, got, tt.expected)
+		}
+	}
+}
+
+func TestRefreshError(t *testing.T) {
+	apiErr := &smithy.GenericAPIError{Code: "Throttling", Message: "Rate exceeded"}
+	api := &mockELBV2{health: []mockHealth{{err: apiErr}}}
+	tgw, _ := newTestWatcher(api)
+
+	err := tgw.refresh(context.Background())
+	if !errors.Is(err, apiErr) {
+		t.Fatalf("got error %v, expected %v", err, apiErr)
+	}
+	if class := classifyError(err); class != ErrClassThrottle {
+		t.Errorf("got class %s, expected %s", class, ErrClassThrottle)
+	}
+}
+
+func TestRefreshConfigError(t *testing.T) {
+	api := &mockELBV2{
+		health:    []mockHealth{{targets: []types.TargetHealthDescription{target("10.0.0.1", types.TargetHealthStateEnumHealthy, "")}}},
+		configErr: &smithy.GenericAPIError{Code: "AccessDenied"},
+	}
+	tgw, m := newTestWatcher(api)
+
+	// the failure waits the backoff, the targets are still described
+	for i := 0; i < 3; i++ {
+		if err := tgw.refresh(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if api.configCalls != 1 || api.calls != 3 {
+		t.Errorf("got %d configuration and %d target health calls, expected 1 and 3", api.configCalls, api.calls)
+	}
+	if m.TargetGroups[tgw.name].Errors != 1 || m.TGErrAuth != 1 {
+		t.Errorf("got %d target group and %d auth errors, expected 1", m.TargetGroups[tgw.name].Errors, m.TGErrAuth)
+	}
+
+	// described again after the backoff
+	api.configErr = nil
+	tgw.configRetry = time.Time{}
+	if err := tgw.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if tgw.config == nil || api.configCalls != 2 {
+		t.Errorf("configuration not described after the backoff, %d calls", api.configCalls)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{&types.TargetGroupNotFoundException{}, ErrClassNotFound},
+		{fmt.Errorf("operation error: %w", &types.LoadBalancerNotFoundException{}), ErrClassNotFound},
+		{&smithy.GenericAPIError{Code: "ThrottlingException"}, ErrClassThrottle},
+		{&smithy.GenericAPIError{Code: "AccessDenied"}, ErrClassAuth},
+		{&v4.SigningError{Err: errors.New("failed to retrieve credentials")}, ErrClassAuth},
+		{fmt.Errorf("get identity: %w", &CredentialsError{Err: errors.New("no EC2 IMDS role found")}), ErrClassAuth},
+		{&smithy.GenericAPIError{Code: "InternalFailure"}, ErrClassOther},
+		{context.DeadlineExceeded, ErrClassOther},
+	}
+	for _, tt := range tests {
+		if got := classifyError(tt.err); got != tt.expected {
+			t.Errorf("classifyError(%v) is %s, expected %s", tt.err, got, tt.expected)
+		}
+	}
+}
+
+func TestResolveTargetGroups(t *testing.T) {
+	api := &mockELBV2{pages: []*elbv2.DescribeTargetGroupsOutput{
+		{
+			TargetGroups: []types.TargetGroup{{TargetGroupArn: aws.String("tg-1")}, {TargetGroupArn: aws.String("tg-2")}},
+			NextMarker:   aws.String("page-1"),
+		},
+		{
+			TargetGroups: []types.TargetGroup{{TargetGroupArn: aws.String("tg-3")}},
+		},
+	}}
+	arns, err := resolveTargetGroups(context.Background(), api, "arn:aws:elasticloadbalancing:us-east-1:123456789012:loadbalancer/net/my-lb/50dc6c495c0c9188")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(arns) != "[tg-1 tg-2 tg-3]" {
+		t.Errorf("got target groups %v, expected [tg-1 tg-2 tg-3]", arns)
+	}
+}
+
+func TestStartStopsOnCancel(t *testing.T) {
+	api := &mockELBV2{health: []mockHealth{{targets: []types.TargetHealthDescription{
+		target("10.0.0.1", types.TargetHealthStateEnumHealthy, ""),
+	}}}}
+	tgw, _ := newTestWatcher(api)
+	ctx, cancel := context.WithCancel(context.Background())
+	tgw.options.Context = ctx
+	tgw.options.Interval = 10 * time.Millisecond
+
+	done := make(chan struct{})
+	go func() {
+		tgw.Start()
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("watcher did not stop when the context was canceled")
+	}
+}
+
+func TestAppStateWaitsBackoff(t *testing.T) {
+	api := &mockELBV2{health: []mockHealth{{err: &smithy.GenericAPIError{Code: "InternalFailure"}}}}
+	tgw, _ := newTestWatcher(api)
+	ctx, cancel := context.WithCancel(context.Background())
+	tgw.options.Context = ctx
+	tgw.options.Interval = time.Second
+
+	// the changes after the first error wait the backoff, of 500ms
+	// at least
+	appState := make(chan server.HCStateChange, 4)
+	for i := 0; i < cap(appState); i++ {
+		appState <- server.HCStateChange{From: server.StateHealthy, To: server.StateUnhealthy}
+	}
+	tgw.options.AppState = appState
+
+	done := make(chan struct{})
+	go func() {
+		tgw.Start()
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+	if api.calls != 1 {
+		t.Errorf("target health described %d times during the backoff, expected 1", api.calls)
+	}
+}
+
+// readEvent reads the last event of the resource from the log.
+func readEvent(t *testing.T, logPath, resource string, v interface{}) {
+	t.Helper()
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := ""
+	for _, text := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		line := replayLine{}
+		if err := json.Unmarshal([]byte(text), &line); err != nil {
+			t.Fatal(err)
+		}
+		if line.Resource == resource {
+			msg = line.Msg
+		}
+	}
+	if msg == "" {
+		t.Fatalf("%s event not sent", resource)
+	}
+	if err := json.Unmarshal([]byte(msg), v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDrainReport(t *testing.T) {
+	api := &mockELBV2{health: []mockHealth{{targets: []types.TargetHealthDescription{
+		target("10.0.0.1", types.TargetHealthStateEnumHealthy, ""),
+	}}}}
+	tgw, _ := newTestWatcher(api)
+	logPath := filepath.Join(t.TempDir(), "events.log")
+	tgw.options.Event = event.NewEventHandler("test", logPath)
+	tgw.options.Interval = time.Second
+	if err := tgw.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if tgw.config == nil || tgw.config.DeregistrationDelaySec != 30 || tgw.config.UnhealthyThreshold != 2 {
+		t.Fatalf("got configuration %+v", tgw.config)
+	}
+
+	// detected in 25s, the thresholds predict 10s to 30s, drained in
+	// 50s with a 30s deregistration delay
+	start := time.Now()
+	tgw.drain.observeApp(server.HCStateChange{From: server.StateHealthy, To: server.StateUnhealthy, Time: start})
+	for _, step := range []struct {
+		from, to string
+		after    time.Duration
+		finished bool
+	}{
+		{TargetStateHealthy, TargetStateDraining, 25 * time.Second, false},
+		{TargetStateDraining, TargetStateUnregistered, 75 * time.Second, true},
+	} {
+		if got := tgw.drain.observeTarget(step.from, step.to, start.Add(step.after)); got != step.finished {
+			t.Fatalf("%s to %s finished the cycle: %v", step.from, step.to, got)
+		}
+	}
+	tgw.finishDrain("10.0.0.1", TargetStateUnregistered, start.Add(75*time.Second))
+
+	report := DrainReport{}
+	readEvent(t, logPath, "drain-report", &report)
+	if report.DetectionMs != 25000 || report.DrainingMs != 50000 || report.Config == nil {
+		t.Errorf("got report %+v", report)
+	}
+	if len(report.Warnings) != 1 || !strings.HasPrefix(report.Warnings[0], "draining took 50s") {
+		t.Errorf("got warnings %q, expected the draining one", report.Warnings)
+	}
+}
+
+func TestExperiment(t *testing.T) {
+	healthy := target("10.0.0.1", types.TargetHealthStateEnumHealthy, "")
+	api := &mockELBV2{health: []mockHealth{
+		{targets: []types.TargetHealthDescription{healthy}},
+		{targets: []types.TargetHealthDescription{healthy}},
+		{targets: []types.TargetHealthDescription{
+			target("10.0.0.1", types.TargetHealthStateEnumDraining, types.TargetHealthReasonEnumDeregistrationInProgress),
+		}},
+		{},
+		{targets: []types.TargetHealthDescription{
+			target("10.0.0.1", types.TargetHealthStateEnumInitial, types.TargetHealthReasonEnumRegistrationInProgress),
+		}},
+		{targets: []types.TargetHealthDescription{healthy}},
+	}}
+	tgw, _ := newTestWatcher(api)
+	logPath := filepath.Join(t.TempDir(), "events.log")
+	tgw.options.Event = event.NewEventHandler("test", logPath)
+	tgw.options.Interval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	tgw.options.Context = ctx
+
+	// the watcher polls the targets, the experiment runs until
+	// it is finished
+	tgw.selfEvents = make(chan selfTransition, 16)
+	done := make(chan struct{})
+	go func() {
+		tgw.Start()
+		close(done)
+	}()
+	err := tgw.runExperiment(ctx, ExperimentOptions{Timeout: time.Second}, tgw.selfEvents)
+	cancel()
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := ExperimentReport{}
+	readEvent(t, logPath, "experiment", &report)
+	if report.Result != ExperimentCompleted || report.ID != "10.0.0.1" || report.Port != 6443 {
+		t.Fatalf("got report %+v", report)
+	}
+	phases := []string{}
+	for _, p := range report.Phases {
+		phases = append(phases, p.Name)
+	}
+	if fmt.Sprint(phases) != "[deregister draining register initial]" {
+		t.Errorf("got phases %v", phases)
+	}
+	if fmt.Sprint(api.deregistered, api.registered) != "[10.0.0.1] [10.0.0.1]" {
+		t.Errorf("got deregistered %v and registered %v targets", api.deregistered, api.registered)
+	}
+}
@@ -0,0 +1,145 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	elbv2 "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+)
+
+// Target group attributes used by the reports.
+const (
+	attrDeregistrationDelay   = "deregistration_delay.timeout_seconds"
+	attrConnectionTermination = "deregistration_delay.connection_termination.enabled"
+	attrCrossZone             = "load_balancing.cross_zone.enabled"
+	attrProxyProtocolV2       = "proxy_protocol_v2.enabled"
+)
+
+// TargetGroupConfig is the configuration of the target group the
+// lab conclusions depend on.
+type TargetGroupConfig struct {
+	Name       string `json:"name"`
+	ARN        string `json:"arn,omitempty"`
+	Protocol   string `json:"protocol,omitempty"`
+	Port       int64  `json:"port,omitempty"`
+	TargetType string `json:"target_type,omitempty"`
+
+	HealthCheckProtocol    string `json:"health_check_protocol,omitempty"`
+	HealthCheckPort        string `json:"health_check_port,omitempty"`
+	HealthCheckPath        string `json:"health_check_path,omitempty"`
+	HealthCheckIntervalSec int64  `json:"health_check_interval_sec"`
+	HealthCheckTimeoutSec  int64  `json:"health_check_timeout_sec"`
+	HealthyThreshold       int64  `json:"healthy_threshold"`
+	UnhealthyThreshold     int64  `json:"unhealthy_threshold"`
+
+	DeregistrationDelaySec int64  `json:"deregistration_delay_sec"`
+	ConnectionTermination  bool   `json:"connection_termination"`
+	CrossZone              string `json:"cross_zone,omitempty"`
+	ProxyProtocolV2        bool   `json:"proxy_protocol_v2"`
+
+	// All the attributes of the target group.
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// ConfigSource is implemented by the sources which describe the
+// target group configuration, nil when it is unknown.
+type ConfigSource interface {
+	DescribeConfig(ctx context.Context) (*TargetGroupConfig, error)
+}
+
+// setAttributes sets the attributes, and the known ones on the fields.
+func (c *TargetGroupConfig) setAttributes(attrs map[string]string) {
+	c.Attributes = attrs
+	c.DeregistrationDelaySec, _ = strconv.ParseInt(attrs[attrDeregistrationDelay], 10, 64)
+	c.ConnectionTermination = attrs[attrConnectionTermination] == "true"
+	c.CrossZone = attrs[attrCrossZone]
+	c.ProxyProtocolV2 = attrs[attrProxyProtocolV2] == "true"
+}
+
+// DescribeConfig describes the target group and its attributes.
+func (src *awsTargetGroup) DescribeConfig(ctx context.Context) (*TargetGroupConfig, error) {
+	out, err := src.client.DescribeTargetGroups(ctx, &elbv2.DescribeTargetGroupsInput{
+		TargetGroupArns: []string{src.arn},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.TargetGroups) == 0 {
+		return nil, fmt.Errorf("target group %s not found", src.name)
+	}
+	tg := out.TargetGroups[0]
+	cfg := TargetGroupConfig{
+		Name:                   aws.ToString(tg.TargetGroupName),
+		ARN:                    aws.ToString(tg.TargetGroupArn),
+		Protocol:               string(tg.Protocol),
+		Port:                   int64(aws.ToInt32(tg.Port)),
+		TargetType:             string(tg.TargetType),
+		HealthCheckProtocol:    string(tg.HealthCheckProtocol),
+		HealthCheckPort:        aws.ToString(tg.HealthCheckPort),
+		HealthCheckPath:        aws.ToString(tg.HealthCheckPath),
+		HealthCheckIntervalSec: int64(aws.ToInt32(tg.HealthCheckIntervalSeconds)),
+		HealthCheckTimeoutSec:  int64(aws.ToInt32(tg.HealthCheckTimeoutSeconds)),
+		HealthyThreshold:       int64(aws.ToInt32(tg.HealthyThresholdCount)),
+		UnhealthyThreshold:     int64(aws.ToInt32(tg.UnhealthyThresholdCount)),
+	}
+
+	attrs, err := src.client.DescribeTargetGroupAttributes(ctx, &elbv2.DescribeTargetGroupAttributesInput{
+		TargetGroupArn: aws.String(src.arn),
+	})
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(attrs.Attributes))
+	for _, a := range attrs.Attributes {
+		values[aws.ToString(a.Key)] = aws.ToString(a.Value)
+	}
+	cfg.setAttributes(values)
+	return &cfg, nil
+}
+
+// refreshConfig describes the target group configuration, sending the
+// snapshot event. Sources without configuration are ignored. The
+// failures are counted and retried with backoff, so the describe
+// calls of the targets keep the rate limit.
+func (tg *TargetGroupWatcher) refreshConfig(ctx context.Context) error {
+	src, ok := tg.source.(ConfigSource)
+	if !ok || tg.config != nil || time.Now().Before(tg.configRetry) {
+		return nil
+	}
+	if err := tg.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	descCtx, cancel := context.WithTimeout(ctx, describeTimeout)
+	defer cancel()
+	cfg, err := src.DescribeConfig(descCtx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		class := classifyError(err)
+		tg.options.Metric.Inc("tg_errors")
+		tg.options.Metric.Inc("tg_err_" + class)
+		tg.options.Metric.IncTargetGroupError(tg.name)
+		if class == ErrClassNotFound || class == ErrClassAuth {
+			tg.configBo.Skip()
+		}
+		delay := tg.configBo.Next()
+		tg.configRetry = time.Now().Add(delay)
+		tg.send(fmt.Sprintf("ERROR describing target group configuration (%s), retrying in %dms: %v", class, delay.Milliseconds(), err))
+		return err
+	}
+	if cfg == nil {
+		return nil
+	}
+	tg.config = cfg
+
+	data, _ := json.Marshal(cfg)
+	if tg.options.Event != nil {
+		tg.options.Event.Send("target", "tg-config", string(data))
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package watcher
+
+import (
+	"errors"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+	"github.com/aws/smithy-go"
+)
+
+// Error classes of the cloud API calls.
+const (
+	ErrClassThrottle = "throttle"
+	ErrClassNotFound = "not_found"
+	ErrClassAuth     = "auth"
+	ErrClassOther    = "other"
+)
+
+var throttleCodes = map[string]struct{}{
+	"Throttling":                             {},
+	"ThrottlingException":                    {},
+	"ThrottledException":                     {},
+	"RequestLimitExceeded":                   {},
+	"RequestThrottled":                       {},
+	"RequestThrottledException":              {},
+	"TooManyRequestsException":               {},
+	"ProvisionedThroughputExceededException": {},
+}
+
+var authCodes = map[string]struct{}{
+	"AccessDenied":                {},
+	"AccessDeniedException":       {},
+	"AuthFailure":                 {},
+	"ExpiredToken":                {},
+	"ExpiredTokenException":       {},
+	"InvalidClientTokenId":        {},
+	"SignatureDoesNotMatch":       {},
+	"UnauthorizedOperation":       {},
+	"UnrecognizedClientException": {},
+}
+
+// classifyError returns the class of the AWS API error.
+func classifyError(err error) string {
+	var tgNotFound *types.TargetGroupNotFoundException
+	var lbNotFound *types.LoadBalancerNotFoundException
+	var credsErr *CredentialsError
+	var signErr *v4.SigningError
+	var apiErr smithy.APIError
+	switch {
+	case errors.As(err, &tgNotFound), errors.As(err, &lbNotFound):
+		return ErrClassNotFound
+	case errors.As(err, &credsErr), errors.As(err, &signErr):
+		return ErrClassAuth
+	case !errors.As(err, &apiErr):
+		return ErrClassOther
+	}
+	if _, ok := throttleCodes[apiErr.ErrorCode()]; ok {
+		return ErrClassThrottle
+	}
+	if _, ok := authCodes[apiErr.ErrorCode()]; ok {
+		return ErrClassAuth
+	}
+	return ErrClassOther
+}
@@ -0,0 +1,262 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	elbv2 "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	"github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+	"github.com/mtulio/go-lab-api/internal/metric"
+)
+
+// defaultExperimentTimeout is the default timeout to wait each state
+// of the experiment, longer than the maximum deregistration delay.
+const defaultExperimentTimeout = 1 * time.Hour
+
+// Experiment results.
+const (
+	ExperimentCompleted = "completed"
+	ExperimentDryRun    = "dry-run"
+	ExperimentFailed    = "failed"
+)
+
+// ExperimentOptions configures the experiment replacing the manual
+// deregistration on the console: the self target is deregistered,
+// it is waited to drain, then it is registered again and waited to be
+// healthy. Each phase is measured with the service traffic.
+type ExperimentOptions struct {
+	// DryRun reports the actions without calling the API.
+	DryRun bool
+
+	// Delay to start the experiment, to have a baseline of traffic.
+	Delay time.Duration
+
+	// Timeout to wait each state of the target, default is 1h.
+	Timeout time.Duration
+}
+
+// TargetRegistrar is implemented by the sources which register and
+// deregister the targets.
+type TargetRegistrar interface {
+	RegisterTarget(ctx context.Context, t Target) error
+	DeregisterTarget(ctx context.Context, t Target) error
+}
+
+// ExperimentPhase is a phase of the experiment, with the states of
+// the self target and the traffic observed meanwhile.
+type ExperimentPhase struct {
+	Name       string         `json:"name"`
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt time.Time      `json:"finished_at"`
+	DurationMs int64          `json:"duration_ms"`
+	States     []string       `json:"states,omitempty"`
+	Traffic    metric.Traffic `json:"traffic"`
+}
+
+// ExperimentReport is sent when the experiment finishes.
+type ExperimentReport struct {
+	TargetGroup string            `json:"target_group"`
+	ID          string            `json:"id,omitempty"`
+	Port        int64             `json:"port,omitempty"`
+	Result      string            `json:"result"`
+	Error       string            `json:"error,omitempty"`
+	Phases      []ExperimentPhase `json:"phases"`
+}
+
+// selfTransition is a transition of the self target, observed by the
+// experiment. The target is nil when it is not registered.
+type selfTransition struct {
+	target *Target
+	to     string
+	time   time.Time
+}
+
+// experiment runs the experiment on the self target transitions
+// observed by the watcher.
+type experiment struct {
+	tg      *TargetGroupWatcher
+	options *ExperimentOptions
+	events  <-chan selfTransition
+	last    selfTransition
+	report  ExperimentReport
+}
+
+// runExperiment runs the experiment of the options, sending the
+// report when it finishes. The options are copied, they are shared
+// by the watchers.
+func (tg *TargetGroupWatcher) runExperiment(ctx context.Context, op ExperimentOptions, events <-chan selfTransition) error {
+	exp := experiment{
+		tg:      tg,
+		options: &op,
+		events:  events,
+		report:  ExperimentReport{TargetGroup: tg.name, Phases: []ExperimentPhase{}},
+	}
+	if exp.options.Timeout == 0 {
+		exp.options.Timeout = defaultExperimentTimeout
+	}
+
+	err := exp.run(ctx)
+	switch {
+	case err != nil:
+		exp.report.Result = ExperimentFailed
+		exp.report.Error = err.Error()
+		tg.send(fmt.Sprintf("Experiment failed: %v", err))
+	case exp.options.DryRun:
+		exp.report.Result = ExperimentDryRun
+	default:
+		exp.report.Result = ExperimentCompleted
+	}
+	data, _ := json.Marshal(&exp.report)
+	if tg.options.Event != nil {
+		tg.options.Event.Send("target", "experiment", string(data))
+	}
+	return err
+}
+
+// run deregisters the self target and waits it to drain, then
+// registers it again and waits it to be healthy.
+func (exp *experiment) run(ctx context.Context) error {
+	registrar, ok := exp.tg.source.(TargetRegistrar)
+	if !ok && !exp.options.DryRun {
+		return fmt.Errorf("the %s source does not register targets", exp.tg.name)
+	}
+
+	exp.tg.send(fmt.Sprintf("Experiment starting in %s, waiting the self target to be healthy", exp.options.Delay))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(exp.options.Delay):
+	}
+	if err := exp.wait(ctx, nil, TargetStateHealthy); err != nil {
+		return err
+	}
+	target := *exp.last.target
+	exp.report.ID = target.ID
+	exp.report.Port = target.Port
+
+	if exp.options.DryRun {
+		exp.tg.send(fmt.Sprintf("Experiment dry-run: would deregister the target %s, wait it to drain, register it again and wait it to be healthy", target.key()))
+		return nil
+	}
+
+	exp.tg.send(fmt.Sprintf("Experiment: deregistering the target %s", target.key()))
+	err := exp.phase(ctx, "deregister", func(p *ExperimentPhase) error {
+		if err := exp.call(ctx, registrar.DeregisterTarget, target); err != nil {
+			return fmt.Errorf("deregister target: %w", err)
+		}
+		return exp.wait(ctx, p, TargetStateDraining, TargetStateUnregistered)
+	})
+	if err == nil {
+		err = exp.phase(ctx, "draining", func(p *ExperimentPhase) error {
+			return exp.wait(ctx, p, TargetStateUnregistered)
+		})
+	}
+	if err != nil {
+		// the target is not left deregistered, even when the
+		// application is exiting.
+		if ctx.Err() != nil {
+			restore, cancel := context.WithTimeout(context.Background(), describeTimeout)
+			defer cancel()
+			ctx = restore
+		}
+		if rerr := registrar.RegisterTarget(ctx, target); rerr != nil {
+			return fmt.Errorf("%v, and register target again: %w", err, rerr)
+		}
+		return err
+	}
+
+	exp.tg.send(fmt.Sprintf("Experiment: registering the target %s", target.key()))
+	err = exp.phase(ctx, "register", func(p *ExperimentPhase) error {
+		if err := exp.call(ctx, registrar.RegisterTarget, target); err != nil {
+			return fmt.Errorf("register target: %w", err)
+		}
+		return exp.wait(ctx, p, TargetStateInitial, TargetStateUnhealthy, TargetStateHealthy)
+	})
+	if err != nil {
+		return err
+	}
+	return exp.phase(ctx, "initial", func(p *ExperimentPhase) error {
+		return exp.wait(ctx, p, TargetStateHealthy)
+	})
+}
+
+// phase measures the phase and the traffic observed meanwhile.
+func (exp *experiment) phase(ctx context.Context, name string, fn func(p *ExperimentPhase) error) error {
+	p := ExperimentPhase{Name: name, StartedAt: time.Now()}
+	traffic := exp.tg.options.Metric.GetTraffic()
+	err := fn(&p)
+	p.FinishedAt = time.Now()
+	p.DurationMs = p.FinishedAt.Sub(p.StartedAt).Milliseconds()
+	p.Traffic = exp.tg.options.Metric.GetTraffic().Sub(traffic)
+	exp.report.Phases = append(exp.report.Phases, p)
+	return err
+}
+
+// call calls the registrar on the rate limit shared by the watchers.
+func (exp *experiment) call(ctx context.Context, fn func(context.Context, Target) error, t Target) error {
+	if err := exp.tg.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, describeTimeout)
+	defer cancel()
+	return fn(ctx, t)
+}
+
+// wait waits the self target to be on one of the states, adding the
+// states seen to the phase.
+func (exp *experiment) wait(ctx context.Context, p *ExperimentPhase, states ...string) error {
+	timer := time.NewTimer(exp.options.Timeout)
+	defer timer.Stop()
+	for {
+		for _, s := range states {
+			if exp.last.to == s {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return fmt.Errorf("timeout waiting the self target to be %v, it is %q", states, exp.last.to)
+		case ev := <-exp.events:
+			exp.last = ev
+			if p != nil {
+				p.States = append(p.States, ev.to)
+			}
+		}
+	}
+}
+
+// RegisterTarget registers the target on the target group.
+func (src *awsTargetGroup) RegisterTarget(ctx context.Context, t Target) error {
+	_, err := src.client.RegisterTargets(ctx, &elbv2.RegisterTargetsInput{
+		TargetGroupArn: aws.String(src.arn),
+		Targets:        []types.TargetDescription{targetDescription(t)},
+	})
+	return err
+}
+
+// DeregisterTarget deregisters the target from the target group.
+func (src *awsTargetGroup) DeregisterTarget(ctx context.Context, t Target) error {
+	_, err := src.client.DeregisterTargets(ctx, &elbv2.DeregisterTargetsInput{
+		TargetGroupArn: aws.String(src.arn),
+		Targets:        []types.TargetDescription{targetDescription(t)},
+	})
+	return err
+}
+
+// targetDescription returns the description of the target to register
+// it as it was: the IP targets outside of the VPC are on all the zones.
+func targetDescription(t Target) types.TargetDescription {
+	d := types.TargetDescription{Id: aws.String(t.ID)}
+	if t.Port > 0 {
+		d.Port = aws.Int32(int32(t.Port))
+	}
+	if t.AZ == "all" {
+		d.AvailabilityZone = aws.String(t.AZ)
+	}
+	return d
+}
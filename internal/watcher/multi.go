@@ -0,0 +1,183 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mtulio/go-lab-api/internal/backoff"
+	"github.com/mtulio/go-lab-api/internal/server"
+)
+
+// MultiWatcher watches multiple target groups concurrently, eg: the
+// internal and external load balancers of the kube-apiserver. The
+// target groups share the rate limit, the self target IDs and the
+// application state.
+type MultiWatcher struct {
+	options *TGWatcherOptions
+	cliSvc  elbv2API
+	limiter *rateLimiter
+
+	// target group and load balancer ARNs
+	arns []string
+
+	// application state of each target group watcher
+	appStates []chan server.HCStateChange
+}
+
+func NewMultiWatcher(op *TGWatcherOptions) (*MultiWatcher, error) {
+	arns := []string{}
+	if op.ARN != "" {
+		arns = append(arns, op.ARN)
+	}
+	arns = append(arns, op.ARNs...)
+	for _, arn := range arns {
+		if !strings.HasPrefix(arn, "arn:") ||
+			!(strings.Contains(arn, ":targetgroup/") || isLoadBalancerARN(arn)) {
+			return nil, fmt.Errorf("invalid target group or load balancer ARN: %s", arn)
+		}
+	}
+	svc, err := newELBV2Client(watcherContext(op), &op.AWS, op.Metric)
+	if err != nil {
+		return nil, err
+	}
+	if op.BackoffMax == 0 {
+		op.BackoffMax = time.Minute
+	}
+	if op.RateLimit == 0 {
+		op.RateLimit = defaultRateLimit
+	}
+	return &MultiWatcher{
+		options: op,
+		cliSvc:  svc,
+		limiter: newRateLimiter(op.RateLimit),
+		arns:    arns,
+	}, nil
+}
+
+// Start resolves the load balancers and starts the watcher of each
+// target group, forwarding the application state changes.
+func (mw *MultiWatcher) Start() {
+	ctx := watcherContext(mw.options)
+	arns, err := mw.resolve(ctx)
+	if err != nil {
+		mw.send("Stopped: " + err.Error())
+		return
+	}
+	watchers := []*TargetGroupWatcher{}
+	for _, arn := range arns {
+		ch := make(chan server.HCStateChange, 1)
+		op := *mw.options
+		op.AppState = ch
+		// the experiments are run in sequence, not by each watcher
+		op.Experiment = nil
+		tgw := NewWatcherWithSource(&op, newAWSTargetGroup(mw.cliSvc, arn))
+		tgw.limiter = mw.limiter
+		watchers = append(watchers, tgw)
+		mw.appStates = append(mw.appStates, ch)
+	}
+
+	if len(watchers) == 0 {
+		mw.send("No target groups to watch")
+		return
+	}
+
+	// the self target is detected once for all target groups
+	selfIDs := watchers[0].detectSelfIDs()
+	mw.send(fmt.Sprintf("Self target IDs: %v", selfIDs))
+	experiment := mw.options.Experiment != nil && len(selfIDs) > 0
+	for _, tgw := range watchers {
+		tgw.selfIDs = selfIDs
+		if experiment {
+			tgw.selfEvents = make(chan selfTransition, 16)
+		}
+		go tgw.Start()
+	}
+	if experiment {
+		go mw.runExperiments(ctx, watchers)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case change := <-mw.options.AppState:
+			server.NotifySubscribers(mw.appStates, change)
+		}
+	}
+}
+
+// runExperiments runs the experiment on each target group in
+// sequence, the self target is deregistered from one target group at
+// a time. The sequence stops on the first failure.
+func (mw *MultiWatcher) runExperiments(ctx context.Context, watchers []*TargetGroupWatcher) {
+	for i, tgw := range watchers {
+		if err := tgw.runExperiment(ctx, *mw.options.Experiment, tgw.selfEvents); err != nil {
+			if skipped := len(watchers) - i - 1; skipped > 0 && ctx.Err() == nil {
+				mw.send(fmt.Sprintf("Experiment failed on %s, skipping the other %d target groups", tgw.name, skipped))
+			}
+			return
+		}
+	}
+}
+
+// resolve returns the target group ARNs, resolving the load balancers
+// to all their target groups. The errors are retried with backoff,
+// until the context is done.
+func (mw *MultiWatcher) resolve(ctx context.Context) ([]string, error) {
+	bo := backoff.New(1000, uint64(mw.options.BackoffMax.Milliseconds()))
+	seen := map[string]bool{}
+	arns := []string{}
+	add := func(arn string) {
+		if !seen[arn] {
+			seen[arn] = true
+			arns = append(arns, arn)
+		}
+	}
+	for _, arn := range mw.arns {
+		if !isLoadBalancerARN(arn) {
+			add(arn)
+			continue
+		}
+		for {
+			if err := mw.limiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+			tgs, err := resolveTargetGroups(ctx, mw.cliSvc, arn)
+			if err == nil {
+				mw.send(fmt.Sprintf("Load balancer %s resolved to target groups %v", resourceName(arn), tgs))
+				for _, tg := range tgs {
+					add(tg)
+				}
+				bo.Reset()
+				break
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			class := classifyError(err)
+			mw.options.Metric.Inc("tg_errors")
+			mw.options.Metric.Inc("tg_err_" + class)
+			if class == ErrClassNotFound || class == ErrClassAuth {
+				bo.Skip()
+			}
+			delay := bo.Next()
+			mw.send(fmt.Sprintf("ERROR resolving load balancer %s (%s), retrying in %dms: %v", resourceName(arn), class, delay.Milliseconds(), err))
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+	return arns, nil
+}
+
+// send sends the watcher event.
+func (mw *MultiWatcher) send(msg string) {
+	if mw.options.Event == nil {
+		return
+	}
+	mw.options.Event.Send("runtime", "tg-watcher", msg)
+}
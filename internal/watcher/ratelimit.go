@@ -0,0 +1,52 @@
+package watcher
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultRateLimit is the default of describe calls per second, the
+// ELBv2 API limits are shared by the account.
+const defaultRateLimit = 5
+
+// rateLimiter spaces the calls shared by the watchers, a nil
+// limiter does not wait.
+type rateLimiter struct {
+	interval time.Duration
+	next     time.Time
+	locker   sync.Mutex
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		interval: time.Duration(float64(time.Second) / perSecond),
+	}
+}
+
+// Wait waits the next slot of the limiter, or the context to be done.
+func (r *rateLimiter) Wait(ctx context.Context) error {
+	if r == nil {
+		return ctx.Err()
+	}
+	r.locker.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	wait := r.next.Sub(now)
+	r.next = r.next.Add(r.interval)
+	r.locker.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,240 @@
+package watcher
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replayStep is the state of the targets from the offset of the replay.
+type replayStep struct {
+	offset  time.Duration
+	targets []Target
+}
+
+// replayLine is one line of the recording: a snapshot of the targets,
+// the target group configuration, or a target transition or
+// configuration event logged by the watcher.
+type replayLine struct {
+	AfterMs int64              `json:"after_ms"`
+	Targets []*Target          `json:"targets"`
+	Config  *TargetGroupConfig `json:"config"`
+
+	Type     string `json:"type"`
+	Resource string `json:"resource"`
+	Msg      string `json:"msg"`
+}
+
+// replaySource is the fake backend replaying the recorded state
+// transitions, from the time it is first described.
+type replaySource struct {
+	steps  []replayStep
+	config *TargetGroupConfig
+	start  time.Time
+	locker sync.Mutex
+}
+
+// httpSource is the fake backend describing the targets from an
+// HTTP endpoint, a local stand-in controlled by the lab.
+type httpSource struct {
+	url    string
+	client *http.Client
+}
+
+// NewReplaySource returns the fake backend of the path. HTTP URLs
+// return the current targets on every request: {"targets": [...]}.
+// Files are JSON lines recordings replayed once, the last state is
+// kept. Each line is a snapshot of the targets from an offset:
+//
+//	{"after_ms": 5000, "targets": [{"id": "10.0.0.10", "port": 80, "state": "draining"}]}
+//
+// or a target event from the log of a previous run, so real runs can
+// be replayed offline. The other lines of the log, and the events of
+// other target groups than the first one, are ignored.
+//
+// The target group configuration compared by the drain reports is
+// set by a line {"config": {...}}, see TargetGroupConfig.
+func NewReplaySource(path string) (TargetSource, error) {
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return &httpSource{
+			url:    path,
+			client: &http.Client{Timeout: 5 * time.Second},
+		}, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	src := replaySource{}
+	state := map[string]Target{}
+	var first time.Time
+	targetGroup := ""
+	tgKnown := false
+	lineNum := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		lineNum += 1
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		line := replayLine{}
+		if err := json.Unmarshal([]byte(text), &line); err != nil {
+			return nil, fmt.Errorf("invalid replay line %d: %v", lineNum, err)
+		}
+
+		var offset time.Duration
+		switch {
+		case line.Targets != nil:
+			offset = time.Duration(line.AfterMs) * time.Millisecond
+			state = map[string]Target{}
+			for _, t := range line.Targets {
+				state[t.key()] = *t
+			}
+		case line.Config != nil:
+			src.config = line.Config
+			continue
+		case line.Type == "target" && line.Resource == "tg-config":
+			cfg := TargetGroupConfig{}
+			if err := json.Unmarshal([]byte(line.Msg), &cfg); err != nil {
+				return nil, fmt.Errorf("invalid target group configuration on line %d: %v", lineNum, err)
+			}
+			if !tgKnown {
+				targetGroup, tgKnown = cfg.Name, true
+			}
+			if cfg.Name == targetGroup {
+				src.config = &cfg
+			}
+			continue
+		case line.Type == "target" && line.Resource == "tg-watcher":
+			ev := TargetEvent{}
+			if err := json.Unmarshal([]byte(line.Msg), &ev); err != nil {
+				return nil, fmt.Errorf("invalid target event on line %d: %v", lineNum, err)
+			}
+			// logs watching multiple target groups replay the first one
+			if !tgKnown {
+				targetGroup, tgKnown = ev.TargetGroup, true
+			}
+			if ev.TargetGroup != targetGroup {
+				continue
+			}
+			if first.IsZero() {
+				first = ev.Time
+			}
+			offset = ev.Time.Sub(first)
+			t := Target{
+				ID:          ev.ID,
+				Port:        ev.Port,
+				AZ:          ev.AZ,
+				State:       ev.To,
+				Reason:      ev.Reason,
+				Description: ev.Description,
+			}
+			if ev.To == TargetStateRemoved {
+				delete(state, t.key())
+			} else {
+				state[t.key()] = t
+			}
+		default:
+			continue
+		}
+		src.add(offset, state)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(src.steps) == 0 {
+		return nil, fmt.Errorf("no targets found on the replay file %s", path)
+	}
+	return &src, nil
+}
+
+// add adds the state from the offset, replacing the last step when
+// it has the same offset (events of the same refresh).
+func (src *replaySource) add(offset time.Duration, state map[string]Target) {
+	targets := make([]Target, 0, len(state))
+	for _, t := range state {
+		targets = append(targets, t)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].key() < targets[j].key()
+	})
+	last := len(src.steps) - 1
+	if last >= 0 && src.steps[last].offset == offset {
+		src.steps[last].targets = targets
+		return
+	}
+	src.steps = append(src.steps, replayStep{offset: offset, targets: targets})
+}
+
+func (src *replaySource) Name() string {
+	return "replay"
+}
+
+// DescribeTargets returns the targets of the current offset, no
+// targets before the first one.
+func (src *replaySource) DescribeTargets(ctx context.Context) ([]*Target, error) {
+	src.locker.Lock()
+	if src.start.IsZero() {
+		src.start = time.Now()
+	}
+	elapsed := time.Since(src.start)
+	src.locker.Unlock()
+
+	targets := []*Target{}
+	for _, step := range src.steps {
+		if step.offset > elapsed {
+			break
+		}
+		targets = targets[:0]
+		for _, t := range step.targets {
+			t := t
+			targets = append(targets, &t)
+		}
+	}
+	return targets, nil
+}
+
+// DescribeConfig returns the recorded target group configuration.
+func (src *replaySource) DescribeConfig(ctx context.Context) (*TargetGroupConfig, error) {
+	return src.config, nil
+}
+
+func (src *httpSource) Name() string {
+	return "replay"
+}
+
+// DescribeTargets requests the current targets to the endpoint.
+func (src *httpSource) DescribeTargets(ctx context.Context) ([]*Target, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := src.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	line := replayLine{}
+	if err := json.NewDecoder(resp.Body).Decode(&line); err != nil {
+		return nil, err
+	}
+	if line.Targets == nil {
+		return []*Target{}, nil
+	}
+	return line.Targets, nil
+}
@@ -0,0 +1,224 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mtulio/go-lab-api/internal/event"
+)
+
+// writeReplay writes the lines on the replay file.
+func writeReplay(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "replay.jsonl")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// describeAt returns the targets of the source at the offset of the
+// replay, as id:port=state.
+func describeAt(t *testing.T, src TargetSource, offset time.Duration) string {
+	t.Helper()
+	if replay, ok := src.(*replaySource); ok {
+		replay.start = time.Now().Add(-offset)
+	}
+	targets, err := src.DescribeTargets(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := []string{}
+	for _, tgt := range targets {
+		states = append(states, fmt.Sprintf("%s=%s", tgt.key(), tgt.State))
+	}
+	return strings.Join(states, ",")
+}
+
+func TestReplaySnapshots(t *testing.T) {
+	src, err := NewReplaySource(writeReplay(t,
+		`{"after_ms": 500, "targets": [{"id": "10.0.0.2", "port": 80, "state": "healthy"}, {"id": "10.0.0.1", "port": 80, "state": "healthy"}]}`,
+		``,
+		`{"after_ms": 1500, "targets": [{"id": "10.0.0.1", "port": 80, "state": "draining"}, {"id": "10.0.0.2", "port": 80, "state": "healthy"}]}`,
+		`{"after_ms": 3000, "targets": [{"id": "10.0.0.2", "port": 80, "state": "healthy"}]}`,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		offset   time.Duration
+		expected string
+	}{
+		{0, ""},
+		{600 * time.Millisecond, "10.0.0.1:80=healthy,10.0.0.2:80=healthy"},
+		{2 * time.Second, "10.0.0.1:80=draining,10.0.0.2:80=healthy"},
+		{3 * time.Second, "10.0.0.2:80=healthy"},
+		// the last state is kept
+		{time.Hour, "10.0.0.2:80=healthy"},
+	}
+	for _, tt := range tests {
+		if got := describeAt(t, src, tt.offset); got != tt.expected {
+			t.Errorf("at %s got targets %q, expected %q", tt.offset, got, tt.expected)
+		}
+	}
+}
+
+// writeEventLog writes the target events of a run on the log, with
+// the other events of the application.
+func writeEventLog(t *testing.T, events ...interface{}) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "events.log")
+	ev := event.NewEventHandler("test", path)
+	defer ev.Close()
+	for _, e := range events {
+		switch e := e.(type) {
+		case string:
+			ev.Send("runtime", "tg-watcher", e)
+		case TargetEvent:
+			data, _ := json.Marshal(&e)
+			ev.Send("target", "tg-watcher", string(data))
+		case TargetGroupConfig:
+			data, _ := json.Marshal(&e)
+			ev.Send("target", "tg-config", string(data))
+		}
+	}
+	return path
+}
+
+func TestReplayEventLog(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	src, err := NewReplaySource(writeEventLog(t,
+		"Self target IDs: [10.0.0.1]",
+		TargetEvent{TargetGroup: "tg-a", ID: "10.0.0.1", Port: 80, To: TargetStateInitial, Time: start},
+		// the events of the other target groups are ignored
+		TargetEvent{TargetGroup: "tg-b", ID: "10.0.0.9", Port: 80, To: TargetStateHealthy, Time: start},
+		TargetEvent{TargetGroup: "tg-a", ID: "10.0.0.1", Port: 80, From: TargetStateInitial, To: TargetStateHealthy, Time: start.Add(2 * time.Second)},
+		TargetEvent{TargetGroup: "tg-a", ID: "10.0.0.2", Port: 80, To: TargetStateHealthy, Time: start.Add(2 * time.Second)},
+		"App state changed from healthy to draining, refreshing target group",
+		TargetEvent{TargetGroup: "tg-a", ID: "10.0.0.1", Port: 80, From: TargetStateHealthy, To: TargetStateDraining, Reason: "Target.DeregistrationInProgress", Time: start.Add(5 * time.Second)},
+		TargetEvent{TargetGroup: "tg-a", ID: "10.0.0.1", Port: 80, From: TargetStateDraining, To: TargetStateRemoved, Time: start.Add(8 * time.Second)},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		offset   time.Duration
+		expected string
+	}{
+		{0, "10.0.0.1:80=initial"},
+		{2 * time.Second, "10.0.0.1:80=healthy,10.0.0.2:80=healthy"},
+		{6 * time.Second, "10.0.0.1:80=draining,10.0.0.2:80=healthy"},
+		{time.Hour, "10.0.0.2:80=healthy"},
+	}
+	for _, tt := range tests {
+		if got := describeAt(t, src, tt.offset); got != tt.expected {
+			t.Errorf("at %s got targets %q, expected %q", tt.offset, got, tt.expected)
+		}
+	}
+	src.(*replaySource).start = time.Now().Add(-6 * time.Second)
+	targets, _ := src.DescribeTargets(context.Background())
+	if targets[0].Reason != "Target.DeregistrationInProgress" {
+		t.Errorf("got reason %q of the draining target", targets[0].Reason)
+	}
+}
+
+func TestReplayConfig(t *testing.T) {
+	src, err := NewReplaySource(writeReplay(t,
+		`{"config": {"name": "my-tg", "deregistration_delay_sec": 30, "unhealthy_threshold": 2}}`,
+		`{"after_ms": 0, "targets": [{"id": "10.0.0.1", "port": 80, "state": "healthy"}]}`,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := src.(ConfigSource).DescribeConfig(context.Background())
+	if err != nil || cfg == nil || cfg.Name != "my-tg" || cfg.DeregistrationDelaySec != 30 || cfg.UnhealthyThreshold != 2 {
+		t.Fatalf("got configuration %+v, error %v", cfg, err)
+	}
+
+	// the configuration of the first target group of the log
+	start := time.Now()
+	src, err = NewReplaySource(writeEventLog(t,
+		TargetGroupConfig{Name: "tg-a", DeregistrationDelaySec: 30},
+		TargetGroupConfig{Name: "tg-b", DeregistrationDelaySec: 300},
+		TargetEvent{TargetGroup: "tg-a", ID: "10.0.0.1", Port: 80, To: TargetStateHealthy, Time: start},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, _ = src.(ConfigSource).DescribeConfig(context.Background())
+	if cfg == nil || cfg.Name != "tg-a" || cfg.DeregistrationDelaySec != 30 {
+		t.Errorf("got configuration %+v, expected the tg-a one", cfg)
+	}
+
+	// the watcher describes the recorded configuration
+	tgw := NewWatcherWithSource(&TGWatcherOptions{RateLimit: -1}, src)
+	tgw.refreshConfig(context.Background())
+	if tgw.config != cfg {
+		t.Errorf("got watcher configuration %+v", tgw.config)
+	}
+}
+
+func TestReplayErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		err   string
+	}{
+		{"invalid line", []string{`{"after_ms": 0, "targets": []}`, `{"after_ms":`}, "invalid replay line 2"},
+		{"no targets", []string{`{"level":"info","msg":"started","type":"runtime"}`}, "no targets found"},
+	}
+	for _, tt := range tests {
+		_, err := NewReplaySource(writeReplay(t, tt.lines...))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, expected %q", tt.name, err, tt.err)
+		}
+	}
+	if _, err := NewReplaySource(filepath.Join(t.TempDir(), "missing.jsonl")); err == nil {
+		t.Error("missing replay file was accepted")
+	}
+}
+
+func TestReplayHTTP(t *testing.T) {
+	var locker sync.Mutex
+	responses := []string{
+		`{"targets": [{"id": "10.0.0.1", "port": 80, "state": "healthy"}]}`,
+		`{"targets": [{"id": "10.0.0.1", "port": 80, "state": "draining"}]}`,
+		`{}`,
+		``,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		locker.Lock()
+		defer locker.Unlock()
+		resp := responses[0]
+		responses = responses[1:]
+		if resp == "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(resp))
+	}))
+	defer srv.Close()
+
+	src, err := NewReplaySource(srv.URL + "/targets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the current targets of the stand-in, on every request
+	for _, expected := range []string{"10.0.0.1:80=healthy", "10.0.0.1:80=draining", ""} {
+		if got := describeAt(t, src, 0); got != expected {
+			t.Errorf("got targets %q, expected %q", got, expected)
+		}
+	}
+	if _, err := src.DescribeTargets(context.Background()); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("got error %v, expected the status code", err)
+	}
+}
@@ -0,0 +1,183 @@
+package watcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/mtulio/go-lab-api/internal/server"
+)
+
+// DrainReport is sent when the self target finishes a drain cycle: it
+// leaves the draining state, it is unregistered, or it is healthy
+// again after failing. The measured timeline is compared with the one
+// predicted by the target group configuration.
+type DrainReport struct {
+	TargetGroup string `json:"target_group,omitempty"`
+	ID          string `json:"id"`
+	FinalState  string `json:"final_state"`
+
+	AppUnhealthyAt *time.Time `json:"app_unhealthy_at,omitempty"`
+	UnhealthyAt    time.Time  `json:"unhealthy_at"`
+	DrainingAt     *time.Time `json:"draining_at,omitempty"`
+	AppHealthyAt   *time.Time `json:"app_healthy_at,omitempty"`
+	FinishedAt     time.Time  `json:"finished_at"`
+
+	// Time from the app failing the health check to the target
+	// leaving healthy, in draining, and from the app passing the
+	// health check to the target being healthy. 0 when unknown.
+	DetectionMs int64 `json:"detection_ms"`
+	DrainingMs  int64 `json:"draining_ms"`
+	RecoveryMs  int64 `json:"recovery_ms"`
+
+	Config   *TargetGroupConfig `json:"config,omitempty"`
+	Warnings []string           `json:"warnings,omitempty"`
+}
+
+// drainTimeline is the timeline of the current drain cycle.
+type drainTimeline struct {
+	appUnhealthyAt time.Time
+	appHealthyAt   time.Time
+	unhealthyAt    time.Time
+	drainingAt     time.Time
+}
+
+// observeApp registers when the application starts and stops failing
+// the health check.
+func (d *drainTimeline) observeApp(change server.HCStateChange) {
+	failing := change.To == server.StateUnhealthy || change.To == server.StateDraining
+	switch {
+	case failing && (d.appUnhealthyAt.IsZero() || !d.appHealthyAt.IsZero()):
+		d.appUnhealthyAt = change.Time
+		d.appHealthyAt = time.Time{}
+	case change.To == server.StateHealthy && !d.appUnhealthyAt.IsZero() && d.appHealthyAt.IsZero():
+		d.appHealthyAt = change.Time
+	}
+}
+
+// observeTarget registers the self target transition, returning
+// whether the drain cycle is finished.
+func (d *drainTimeline) observeTarget(from, to string, now time.Time) bool {
+	if d.unhealthyAt.IsZero() {
+		if from != TargetStateHealthy {
+			return false
+		}
+		switch to {
+		case TargetStateUnhealthy, TargetStateDraining:
+			d.unhealthyAt = now
+			if to == TargetStateDraining {
+				d.drainingAt = now
+			}
+		case TargetStateUnregistered:
+			// drained between two refreshes
+			d.unhealthyAt = now
+			return true
+		}
+		return false
+	}
+	switch {
+	case to == TargetStateDraining:
+		d.drainingAt = now
+		return false
+	case from == TargetStateDraining, to == TargetStateHealthy, to == TargetStateUnregistered:
+		return true
+	}
+	return false
+}
+
+// finishDrain sends the report of the finished drain cycle, starting
+// a new one.
+func (tg *TargetGroupWatcher) finishDrain(id, state string, now time.Time) {
+	d := &tg.drain
+	report := DrainReport{
+		TargetGroup: tg.name,
+		ID:          id,
+		FinalState:  state,
+		UnhealthyAt: d.unhealthyAt,
+		FinishedAt:  now,
+		Config:      tg.config,
+	}
+	warn := func(format string, args ...interface{}) {
+		report.Warnings = append(report.Warnings, fmt.Sprintf(format, args...))
+	}
+
+	if !d.appUnhealthyAt.IsZero() {
+		at := d.appUnhealthyAt
+		report.AppUnhealthyAt = &at
+		if at.After(d.unhealthyAt) {
+			warn("target left healthy %s before the app failed the health check", at.Sub(d.unhealthyAt).Round(time.Millisecond))
+		} else {
+			report.DetectionMs = d.unhealthyAt.Sub(at).Milliseconds()
+		}
+	}
+	if !d.drainingAt.IsZero() {
+		at := d.drainingAt
+		report.DrainingAt = &at
+		report.DrainingMs = now.Sub(at).Milliseconds()
+	}
+	if !d.appHealthyAt.IsZero() && state == TargetStateHealthy {
+		at := d.appHealthyAt
+		report.AppHealthyAt = &at
+		report.RecoveryMs = now.Sub(at).Milliseconds()
+	}
+
+	if tg.config == nil {
+		warn("target group configuration is unknown, the timeline is not compared")
+	} else {
+		tg.compareTimeline(&report, warn)
+	}
+
+	data, _ := json.Marshal(&report)
+	if tg.options.Event != nil {
+		tg.options.Event.Send("target", "drain-report", string(data))
+	}
+
+	// the app failure is kept while it has not recovered
+	tg.drain = drainTimeline{}
+	if d.appHealthyAt.IsZero() {
+		tg.drain.appUnhealthyAt = d.appUnhealthyAt
+	}
+}
+
+// compareTimeline warns when the measured timeline disagrees with
+// the one predicted by the health check thresholds and the
+// deregistration delay. The tolerance is the watcher resolution.
+func (tg *TargetGroupWatcher) compareTimeline(r *DrainReport, warn func(format string, args ...interface{})) {
+	cfg := tg.config
+	interval := time.Duration(cfg.HealthCheckIntervalSec) * time.Second
+	timeout := time.Duration(cfg.HealthCheckTimeoutSec) * time.Second
+	poll := tg.options.Interval
+	if poll == 0 {
+		poll = time.Second
+	}
+	tolerance := 2*poll + time.Second
+
+	// the failures needed are counted from a check in the next interval
+	predict := func(step string, measuredMs, threshold int64) {
+		measured := time.Duration(measuredMs) * time.Millisecond
+		min := time.Duration(threshold-1) * interval
+		max := time.Duration(threshold)*interval + timeout
+		switch {
+		case measured > max+tolerance:
+			warn("%s took %s, the health check predicts at most %s (%d x %s interval + %s timeout)",
+				step, measured, max, threshold, interval, timeout)
+		case measured < min-tolerance:
+			warn("%s took %s, the health check predicts at least %s (%d x %s interval), more health checkers than expected?",
+				step, measured, min, threshold-1, interval)
+		}
+	}
+	if r.AppUnhealthyAt != nil && r.DetectionMs > 0 {
+		predict("unhealthy detection", r.DetectionMs, cfg.UnhealthyThreshold)
+	}
+	if r.AppHealthyAt != nil {
+		predict("healthy detection", r.RecoveryMs, cfg.HealthyThreshold)
+	}
+
+	if r.DrainingAt != nil && r.FinalState != TargetStateDraining {
+		delay := time.Duration(cfg.DeregistrationDelaySec) * time.Second
+		draining := time.Duration(r.DrainingMs) * time.Millisecond
+		if draining > delay+tolerance {
+			warn("draining took %s, more than the deregistration delay of %s", draining, delay)
+		}
+	}
+}
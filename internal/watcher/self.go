@@ -0,0 +1,201 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mtulio/go-lab-api/internal/server"
+)
+
+// TargetStateUnregistered is the state of the self target when it
+// is not registered on the target group.
+const TargetStateUnregistered = "unregistered"
+
+// defaultMetadataEndpoint is the EC2 instance metadata service.
+const defaultMetadataEndpoint = "http://169.254.169.254"
+
+// SelfTargetEvent is sent when the target of this instance changes,
+// with the state of the Health Check Controller to build the drain
+// timeline.
+type SelfTargetEvent struct {
+	TargetGroup string    `json:"target_group,omitempty"`
+	ID          string    `json:"id"`
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	Reason      string    `json:"reason,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Time        time.Time `json:"time"`
+	AppState    string    `json:"app_state"`
+	// Time since the last application state change.
+	AppStateAgeMs int64 `json:"app_state_age_ms"`
+}
+
+// detectSelfIDs returns the IDs which identify this instance on the
+// target group: the configured one, or the local IPs and the instance
+// ID from the metadata service.
+func (tg *TargetGroupWatcher) detectSelfIDs() []string {
+	if tg.options.SelfTarget != "" {
+		return []string{tg.options.SelfTarget}
+	}
+
+	ids := []string{}
+	if id, err := instanceID(tg.options.MetadataEndpoint); err == nil {
+		ids = append(ids, id)
+	} else {
+		tg.send(fmt.Sprintf("Unable to get the instance ID from metadata: %v", err))
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		tg.send(fmt.Sprintf("Unable to list the local addresses: %v", err))
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		ids = append(ids, ipNet.IP.String())
+	}
+	return ids
+}
+
+// instanceID returns the instance ID from the metadata service,
+// using the IMDSv2 token when it is available.
+func instanceID(endpoint string) (string, error) {
+	if endpoint == "" {
+		endpoint = defaultMetadataEndpoint
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	token := ""
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			token = string(body)
+		}
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/latest/meta-data/instance-id", nil)
+	if err != nil {
+		return "", err
+	}
+	if token != "" {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// findSelf returns the target of this instance, nil when it
+// is not registered. The target is matched by ID and by the self
+// port when it is set.
+func (tg *TargetGroupWatcher) findSelf(targets []*Target) *Target {
+	for _, id := range tg.selfIDs {
+		for _, t := range targets {
+			if t.ID != id {
+				continue
+			}
+			if tg.options.SelfPort != 0 && t.Port != tg.options.SelfPort {
+				continue
+			}
+			return t
+		}
+	}
+	return nil
+}
+
+// updateSelf updates the state of the self target, sending the
+// event correlated with the application state.
+func (tg *TargetGroupWatcher) updateSelf(targets []*Target) {
+	if len(tg.selfIDs) == 0 {
+		return
+	}
+	self := tg.findSelf(targets)
+	ev := SelfTargetEvent{
+		TargetGroup: tg.name,
+		ID:          strings.Join(tg.selfIDs, ","),
+		To:          TargetStateUnregistered,
+		Time:        time.Now(),
+	}
+	if self != nil {
+		ev.ID = self.ID
+		ev.To = self.State
+		ev.Reason = self.Reason
+		ev.Description = self.Description
+	}
+	if ev.To == tg.selfState {
+		return
+	}
+	ev.From = tg.selfState
+	tg.selfState = ev.To
+	tg.options.Metric.SetTargetGroupSelf(tg.name, ev.To)
+	if tg.selfEvents != nil {
+		tr := selfTransition{to: ev.To, time: ev.Time}
+		if self != nil {
+			t := *self
+			tr.target = &t
+		}
+		// the oldest transition is dropped when the experiment is
+		// not reading, eg: waiting its turn, so the last is kept
+		for sent := false; !sent; {
+			select {
+			case tg.selfEvents <- tr:
+				sent = true
+			default:
+				select {
+				case <-tg.selfEvents:
+				default:
+				}
+			}
+		}
+	}
+
+	ev.AppState = "unknown"
+	if !tg.appStateTime.IsZero() {
+		ev.AppState = tg.appState.String()
+		ev.AppStateAgeMs = ev.Time.Sub(tg.appStateTime).Milliseconds()
+	}
+	data, _ := json.Marshal(&ev)
+	if tg.options.Event != nil {
+		tg.options.Event.Send("target", "self-target", string(data))
+	}
+	if tg.drain.observeTarget(ev.From, ev.To, ev.Time) {
+		tg.finishDrain(ev.ID, ev.To, ev.Time)
+	}
+}
+
+// setAppState registers the application state, the self target
+// transitions are correlated with it.
+func (tg *TargetGroupWatcher) setAppState(change server.HCStateChange) {
+	if change.From == change.To && !tg.appStateTime.IsZero() {
+		return
+	}
+	tg.appState = change.To
+	tg.appStateTime = change.Time
+	tg.drain.observeApp(change)
+}
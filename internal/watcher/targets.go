@@ -0,0 +1,120 @@
+package watcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Target states reported by the load balancer.
+const (
+	TargetStateHealthy     = "healthy"
+	TargetStateUnhealthy   = "unhealthy"
+	TargetStateDraining    = "draining"
+	TargetStateInitial     = "initial"
+	TargetStateUnused      = "unused"
+	TargetStateUnavailable = "unavailable"
+
+	// The target is not registered anymore.
+	TargetStateRemoved = "removed"
+)
+
+// Target is the health of one target of the target group.
+type Target struct {
+	ID          string    `json:"id"`
+	Port        int64     `json:"port"`
+	AZ          string    `json:"az,omitempty"`
+	State       string    `json:"state"`
+	Reason      string    `json:"reason,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Since       time.Time `json:"since"`
+}
+
+// TargetEvent is sent on every target transition.
+type TargetEvent struct {
+	TargetGroup string    `json:"target_group,omitempty"`
+	ID          string    `json:"id"`
+	Port        int64     `json:"port"`
+	AZ          string    `json:"az,omitempty"`
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	Reason      string    `json:"reason,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Time        time.Time `json:"time"`
+	// Time in the previous state, 0 when the target is new.
+	DurationMs int64 `json:"duration_ms"`
+}
+
+func (t *Target) key() string {
+	return fmt.Sprintf("%s:%d", t.ID, t.Port)
+}
+
+// updateTargets compares the targets with the last ones, sending
+// the transitions and updating the metrics.
+func (tg *TargetGroupWatcher) updateTargets(targets []*Target) {
+	now := time.Now()
+	current := make(map[string]*Target, len(targets))
+	events := []*TargetEvent{}
+
+	for _, t := range targets {
+		t.Since = now
+		prev, ok := tg.targets[t.key()]
+		switch {
+		case !ok:
+			events = append(events, newTargetEvent(t, "", now, time.Time{}))
+		case prev.State != t.State || prev.Reason != t.Reason:
+			events = append(events, newTargetEvent(t, prev.State, now, prev.Since))
+		default:
+			t.Since = prev.Since
+		}
+		current[t.key()] = t
+	}
+	for key, prev := range tg.targets {
+		if _, ok := current[key]; ok {
+			continue
+		}
+		removed := *prev
+		removed.State = TargetStateRemoved
+		removed.Reason = ""
+		removed.Description = ""
+		events = append(events, newTargetEvent(&removed, prev.State, now, prev.Since))
+	}
+	tg.targets = current
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].ID < events[j].ID
+	})
+	for _, ev := range events {
+		ev.TargetGroup = tg.name
+		data, _ := json.Marshal(ev)
+		if tg.options.Event != nil {
+			tg.options.Event.Send("target", "tg-watcher", string(data))
+		}
+	}
+
+	counts := map[string]uint64{}
+	for _, t := range targets {
+		counts[t.State] += 1
+	}
+	tg.options.Metric.SetTargetGroupStates(tg.name, counts)
+
+	tg.updateSelf(targets)
+}
+
+func newTargetEvent(t *Target, from string, now, since time.Time) *TargetEvent {
+	ev := TargetEvent{
+		ID:          t.ID,
+		Port:        t.Port,
+		AZ:          t.AZ,
+		From:        from,
+		To:          t.State,
+		Reason:      t.Reason,
+		Description: t.Description,
+		Time:        now,
+	}
+	if !since.IsZero() {
+		ev.DurationMs = now.Sub(since).Milliseconds()
+	}
+	return &ev
+}
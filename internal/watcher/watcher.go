@@ -0,0 +1,283 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mtulio/go-lab-api/internal/backoff"
+	"github.com/mtulio/go-lab-api/internal/event"
+	"github.com/mtulio/go-lab-api/internal/metric"
+	"github.com/mtulio/go-lab-api/internal/server"
+)
+
+// TargetWatcher watches the health of the targets of a load balancer.
+type TargetWatcher interface {
+	Start()
+}
+
+// TargetSource describes the targets of a load balancer, the
+// watcher polls it and reports the transitions. The name labels
+// the metrics and the events of the source.
+type TargetSource interface {
+	Name() string
+	DescribeTargets(ctx context.Context) ([]*Target, error)
+}
+
+// describeTimeout is the timeout to describe the targets.
+const describeTimeout = 10 * time.Second
+
+type TargetGroupWatcher struct {
+	options *TGWatcherOptions
+	source  TargetSource
+	name    string
+
+	// limiter is shared by the watchers of the same API
+	limiter *rateLimiter
+
+	// last targets, by ID and port
+	targets map[string]*Target
+
+	// target group configuration, described once. The failures are
+	// retried with backoff, not before configRetry.
+	config      *TargetGroupConfig
+	configBo    *backoff.Backoff
+	configRetry time.Time
+
+	// drain timeline of the self target
+	drain drainTimeline
+
+	// self target transitions observed by the experiment
+	selfEvents chan selfTransition
+
+	// IDs and state of the target of this instance
+	selfIDs   []string
+	selfState string
+
+	// last application state, correlated with the self target
+	appState     server.HCState
+	appStateTime time.Time
+}
+
+type TGWatcherOptions struct {
+	ARN      string
+	Interval time.Duration
+	Metric   *metric.MetricsHandler
+	Event    *event.EventHandler
+
+	// Context stops the watcher and cancels the API calls when it is
+	// done, default is to watch until the application exits.
+	Context context.Context
+
+	// ARNs of the target groups or load balancers, watched with ARN.
+	// The load balancers are resolved to all their target groups, the
+	// target groups are polled concurrently.
+	ARNs []string
+
+	// AWS configures the client of the AWS target groups.
+	AWS AWSOptions
+
+	// Replay is the file or the HTTP URL of the fake backend, used
+	// instead of the AWS target group. See NewReplaySource.
+	Replay string
+
+	// Maximum delay between retries on errors, default is 1m.
+	BackoffMax time.Duration
+
+	// RateLimit is the maximum of describe calls per second, shared
+	// by all the target groups. Zero is the default of 5, negative
+	// is disabled (not exposed by the CLI flags).
+	RateLimit float64
+
+	// AppState notifies the application state changes, the
+	// target group is refreshed right away, or at the end of the
+	// backoff delay after an error.
+	AppState <-chan server.HCStateChange
+
+	// SelfTarget is the target ID (IP or instance ID) of this
+	// instance, auto-detected from the local IPs and the instance
+	// metadata when empty.
+	SelfTarget string
+
+	// SelfPort is the port of the target of this instance, the
+	// targets of the self IDs on other ports are not this instance.
+	// Zero matches the self IDs on any port.
+	SelfPort int64
+
+	// MetadataEndpoint is the instance metadata service, it can
+	// be replaced by a local stand-in on labs.
+	MetadataEndpoint string
+
+	// Experiment deregisters and registers again the self target of
+	// each target group, one target group at a time, nil is disabled.
+	// See ExperimentOptions.
+	Experiment *ExperimentOptions
+}
+
+// NewTargetWatcher returns the watcher of the options: the fake
+// backend when Replay is set, the AWS target groups when the ARNs
+// are set, otherwise the no-op watcher.
+func NewTargetWatcher(op *TGWatcherOptions) (TargetWatcher, error) {
+	switch {
+	case op.Replay != "":
+		src, err := NewReplaySource(op.Replay)
+		if err != nil {
+			return nil, err
+		}
+		return NewWatcherWithSource(op, src), nil
+	case op.ARN != "" || len(op.ARNs) > 0:
+		return NewMultiWatcher(op)
+	}
+	return &NoopWatcher{}, nil
+}
+
+// NewWatcherWithSource returns the watcher polling the source.
+func NewWatcherWithSource(op *TGWatcherOptions, src TargetSource) *TargetGroupWatcher {
+	if op.BackoffMax == 0 {
+		op.BackoffMax = time.Minute
+	}
+	if op.RateLimit == 0 {
+		op.RateLimit = defaultRateLimit
+	}
+	return &TargetGroupWatcher{
+		options: op,
+		source:  src,
+		name:    src.Name(),
+		limiter: newRateLimiter(op.RateLimit),
+		targets: make(map[string]*Target),
+
+		configBo: backoff.New(uint64(time.Second.Milliseconds()), uint64(op.BackoffMax.Milliseconds())),
+	}
+}
+
+// watcherContext returns the context of the options.
+func watcherContext(op *TGWatcherOptions) context.Context {
+	if op.Context == nil {
+		return context.Background()
+	}
+	return op.Context
+}
+
+// Start polls the target group health on the interval, until the
+// context is done. The errors are retried with backoff.
+func (tg *TargetGroupWatcher) Start() {
+	ctx := watcherContext(tg.options)
+	interval := tg.options.Interval
+	if interval == 0 {
+		interval = time.Second
+	}
+	if tg.selfIDs == nil {
+		tg.selfIDs = tg.detectSelfIDs()
+		tg.send(fmt.Sprintf("Self target IDs: %v", tg.selfIDs))
+	}
+	if tg.options.Experiment != nil && len(tg.selfIDs) > 0 {
+		tg.selfEvents = make(chan selfTransition, 16)
+		go tg.runExperiment(ctx, *tg.options.Experiment, tg.selfEvents)
+	}
+
+	bo := backoff.New(uint64(interval.Milliseconds()), uint64(tg.options.BackoffMax.Milliseconds()))
+	var errCount uint64 = 0
+	// end of the backoff delay after an error, the app state changes
+	// don't refresh before it.
+	var retryAt time.Time
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			tg.send("Stopped: " + ctx.Err().Error())
+			return
+		case <-timer.C:
+		case change := <-tg.options.AppState:
+			tg.setAppState(change)
+			if wait := time.Until(retryAt); wait > 0 {
+				if change.From != change.To {
+					msg := fmt.Sprintf("App state changed from %s to %s, refreshing target group after the backoff in %dms", change.From, change.To, wait.Milliseconds())
+					tg.send(msg)
+				}
+				continue
+			}
+			if change.From != change.To {
+				msg := fmt.Sprintf("App state changed from %s to %s, refreshing target group", change.From, change.To)
+				tg.send(msg)
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		}
+
+		if err := tg.refresh(ctx); err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			errCount += 1
+			class := classifyError(err)
+			tg.options.Metric.Inc("tg_errors")
+			tg.options.Metric.Inc("tg_err_" + class)
+			tg.options.Metric.IncTargetGroupError(tg.name)
+
+			// not found and auth errors are not expected to recover
+			// soon, the next attempt waits the maximum backoff.
+			if class == ErrClassNotFound || class == ErrClassAuth {
+				bo.Skip()
+			}
+			// throttling grows the backoff twice as fast, leaving
+			// the rate limit to the other callers.
+			if class == ErrClassThrottle {
+				bo.Next()
+			}
+			delay := bo.Next()
+			msg := fmt.Sprintf("ERROR describing target health (%s), retrying in %dms: %v", class, delay.Milliseconds(), err)
+			tg.send(msg)
+			retryAt = time.Now().Add(delay)
+			timer.Reset(delay)
+			continue
+		}
+		retryAt = time.Time{}
+
+		if errCount > 0 {
+			msg := fmt.Sprintf("Target health recovered after %d errors", errCount)
+			tg.send(msg)
+			errCount = 0
+		}
+		bo.Reset()
+		timer.Reset(interval)
+	}
+}
+
+// send sends the watcher event.
+func (tg *TargetGroupWatcher) send(msg string) {
+	if tg.options.Event == nil {
+		return
+	}
+	if tg.name != "" {
+		msg = fmt.Sprintf("[%s] %s", tg.name, msg)
+	}
+	tg.options.Event.Send("runtime", "tg-watcher", msg)
+}
+
+// refresh describes the target health and update the metrics.
+func (tg *TargetGroupWatcher) refresh(ctx context.Context) error {
+	tg.refreshConfig(ctx)
+	if err := tg.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, describeTimeout)
+	defer cancel()
+	targets, err := tg.source.DescribeTargets(ctx)
+	if err != nil {
+		return err
+	}
+	tg.updateTargets(targets)
+	return nil
+}
+
+// NoopWatcher is the watcher used when there is no load balancer
+// to watch.
+type NoopWatcher struct{}
+
+func (w *NoopWatcher) Start() {}